@@ -10,10 +10,19 @@ require (
 require (
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
-	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
 )
 
 require (
 	github.com/eclipse/paho.golang v0.10.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/gorilla/websocket v1.5.0
+	github.com/rabbitmq/amqp091-go v1.5.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.0
 	github.com/spf13/pflag v1.0.5
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
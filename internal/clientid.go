@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadClientID returns the MQTT client id stored in fpath. If fpath does not
+// exist a new id is generated and written to fpath so the same id, and
+// therefore the same broker session, is used across restarts.
+func LoadClientID(fpath string) (string, error) {
+	data, err := os.ReadFile(fpath)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("reading client id: %w", err)
+	}
+
+	// 20 alphanumeric characters is the longest id MQTT 3.1.1 brokers must accept
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating client id: %w", err)
+	}
+	id := "wis2" + hex.EncodeToString(buf)
+	if err := os.WriteFile(fpath, []byte(id+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("writing client id: %w", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadClientID(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, ".client-id")
+
+	id, err := LoadClientID(fpath)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(id) != 20 {
+		t.Errorf("expected a 20 character id, got %s", id)
+	}
+	again, err := LoadClientID(fpath)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if again != id {
+		t.Errorf("expected persisted id %s, got %s", id, again)
+	}
+
+	os.WriteFile(fpath, []byte("my-client\n"), 0o644)
+	if id, _ := LoadClientID(fpath); id != "my-client" {
+		t.Errorf("expected existing id my-client, got %s", id)
+	}
+
+	if _, err := LoadClientID(filepath.Join(dir, "missing", ".client-id")); err == nil {
+		t.Errorf("expected error for missing directory")
+	}
+}
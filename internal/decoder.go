@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decoder decodes a raw notification body into the common message model.
+type Decoder interface {
+	// Name is the unique name used to select this decoder in configuration.
+	Name() string
+	// Detect returns true if body looks like something this decoder can decode.
+	Detect(body []byte) bool
+	Decode(body []byte) (WISMessage, error)
+}
+
+// Decoders is a registry of Decoder implementations shared by all Receivers.
+//
+// A decoder for a message is selected, in order of precedence, by a decoder
+// assigned to a topic filter matching the message topic, by the content type
+// of the message, if provided by the transport, or by asking each registered
+// decoder in registration order whether it can decode the message body.
+type Decoders struct {
+	mu           sync.RWMutex
+	decoders     []Decoder
+	byName       map[string]Decoder
+	contentTypes map[string]Decoder
+	assigned     []assignedDecoder
+}
+
+type assignedDecoder struct {
+	filter  string
+	decoder Decoder
+}
+
+// DefaultDecoders contains the decoders for all formats supported out of the box.
+var DefaultDecoders = NewDecoders()
+
+func init() {
+	DefaultDecoders.Register(WNMDecoder{}, "application/geo+json")
+	DefaultDecoders.Register(GTSDecoder{})
+}
+
+func NewDecoders() *Decoders {
+	return &Decoders{
+		byName:       map[string]Decoder{},
+		contentTypes: map[string]Decoder{},
+	}
+}
+
+// Register adds a decoder to the registry, replacing any existing decoder with
+// the same name. The decoder will be used for any of the provided content types.
+func (r *Decoders) Register(d Decoder, contentTypes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byName[d.Name()]; ok {
+		for i, existing := range r.decoders {
+			if existing.Name() == d.Name() {
+				r.decoders[i] = d
+			}
+		}
+	} else {
+		r.decoders = append(r.decoders, d)
+	}
+	r.byName[d.Name()] = d
+	for _, ct := range contentTypes {
+		r.contentTypes[strings.ToLower(ct)] = d
+	}
+}
+
+// Lookup returns the decoder registered with name, or nil if there is none.
+func (r *Decoders) Lookup(name string) Decoder {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byName[name]
+}
+
+// Assign configures messages with topics matching the MQTT topic filter to always
+// be decoded by the decoder registered with name.
+func (r *Decoders) Assign(filter, name string) error {
+	d := r.Lookup(name)
+	if d == nil {
+		return fmt.Errorf("no decoder named '%s'", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.assigned = append(r.assigned, assignedDecoder{filter: filter, decoder: d})
+	return nil
+}
+
+// Find returns the decoder that should be used for the message, or nil if there
+// is not one.
+func (r *Decoders) Find(topic, contentType string, body []byte) Decoder {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, a := range r.assigned {
+		if topicMatches(a.filter, topic) {
+			return a.decoder
+		}
+	}
+	// strip any parameters, e.g., ; charset=utf-8
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if d, ok := r.contentTypes[contentType]; ok {
+		return d
+	}
+	for _, d := range r.decoders {
+		if d.Detect(body) {
+			return d
+		}
+	}
+	return nil
+}
+
+// Decode a message received on topic. contentType may be empty if the transport
+// does not provide it.
+func (r *Decoders) Decode(topic, contentType string, body []byte) (*Message, error) {
+	msg := &Message{
+		Received: time.Now().UTC(),
+		Topic:    topic,
+		Raw:      body,
+	}
+	d := r.Find(topic, contentType, body)
+	if d == nil {
+		return msg, fmt.Errorf("no decoder for message")
+	}
+	msg.Format = d.Name()
+	var err error
+	msg.Payload, err = d.Decode(body)
+	if err != nil {
+		return msg, fmt.Errorf("%s: %w", d.Name(), err)
+	}
+	return msg, nil
+}
+
+// matchesAny returns true if topic matches any of the topic filters.
+func matchesAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicMatches returns true if topic matches the MQTT topic filter, which may
+// contain + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	fparts := strings.Split(filter, "/")
+	tparts := strings.Split(topic, "/")
+	for i, f := range fparts {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tparts) {
+			return false
+		}
+		if f != "+" && f != tparts[i] {
+			return false
+		}
+	}
+	return len(fparts) == len(tparts)
+}
+
+// WNMDecoder decodes WIS2 Notification Messages.
+type WNMDecoder struct{}
+
+func (WNMDecoder) Name() string { return "wnm" }
+
+// Detect returns true if the message body looks like a WIS2 Notification Message,
+// i.e., a GeoJSON feature with properties or links.
+func (WNMDecoder) Detect(body []byte) bool {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false
+	}
+	if v, ok := doc["type"]; ok && string(v) == `"Feature"` {
+		return true
+	}
+	_, hasProps := doc["properties"]
+	_, hasLinks := doc["links"]
+	return hasProps || hasLinks
+}
+
+func (WNMDecoder) Decode(body []byte) (WISMessage, error) {
+	var wnm WNMessage
+	wis := WISMessage{}
+	if err := json.Unmarshal(body, &wnm); err != nil {
+		return wis, fmt.Errorf("invalid json: %w", err)
+	}
+	wis.ID = wnm.ID
+	wis.DataID = wnm.Properties.DataID
+	wis.MetadataID = wnm.Properties.MetadataID
+	wis.PubTime = wnm.Properties.PubTime
+	wis.Links = wnm.Links
+	wis.Content = wnm.Properties.Content
+	if string(wnm.Geometry) != "null" {
+		wis.Geometry = wnm.Geometry
+	}
+	if l := wis.DataLink(); l != nil {
+		wis.Size = l.Length
+	}
+
+	if wnm.Properties.Integrity != nil {
+		wis.Integrity = normalizeIntegrity(*wnm.Properties.Integrity)
+	}
+
+	return wis, nil
+}
+
+// GTSDecoder decodes legacy messages as defined by
+// https://github.com/wmo-im/GTStoWIS2/tree/main/message_format.
+type GTSDecoder struct{}
+
+func (GTSDecoder) Name() string { return "gtstowis2" }
+
+// Detect returns true for any JSON object, so this decoder should be registered
+// after any more specific decoders.
+func (GTSDecoder) Detect(body []byte) bool {
+	var doc map[string]json.RawMessage
+	return json.Unmarshal(body, &doc) == nil
+}
+
+func (GTSDecoder) Decode(body []byte) (WISMessage, error) {
+	var wis WISMessage
+	if err := json.Unmarshal(body, &wis); err != nil {
+		return wis, fmt.Errorf("invalid json: %w", err)
+	}
+
+	wis.Integrity = normalizeIntegrity(wis.Integrity)
+
+	return wis, nil
+}
@@ -0,0 +1,86 @@
+package internal
+
+import "testing"
+
+type stubDecoder struct {
+	name   string
+	detect bool
+}
+
+func (d stubDecoder) Name() string         { return d.name }
+func (d stubDecoder) Detect(b []byte) bool { return d.detect }
+func (d stubDecoder) Decode(b []byte) (WISMessage, error) {
+	return WISMessage{ID: d.name}, nil
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		Filter, Topic string
+		Expected      bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b/c", true},
+		{"+/+", "a/b/c", false},
+	}
+	for _, test := range tests {
+		if got := topicMatches(test.Filter, test.Topic); got != test.Expected {
+			t.Errorf("filter=%s topic=%s expected %v, got %v", test.Filter, test.Topic, test.Expected, got)
+		}
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	reg := NewDecoders()
+	reg.Register(stubDecoder{"sniffed", true})
+	reg.Register(stubDecoder{"typed", false}, "application/x-typed")
+	reg.Register(stubDecoder{"assigned", false})
+	if err := reg.Assign("a/+/c", "assigned"); err != nil {
+		t.Fatalf("failed to assign: %s", err)
+	}
+
+	tests := []struct {
+		Name, Topic, ContentType, Expected string
+	}{
+		{"assigned topic takes precedence", "a/b/c", "application/x-typed", "assigned"},
+		{"content type", "x/y", "application/x-typed; charset=utf-8", "typed"},
+		{"sniffing", "x/y", "", "sniffed"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			msg, err := reg.Decode(test.Topic, test.ContentType, []byte("{}"))
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if msg.Payload.ID != test.Expected {
+				t.Errorf("expected decoder %s, got %s", test.Expected, msg.Payload.ID)
+			}
+		})
+	}
+
+	t.Run("assign unknown", func(t *testing.T) {
+		if err := reg.Assign("#", "nope"); err == nil {
+			t.Errorf("expected error assigning unknown decoder")
+		}
+	})
+
+	t.Run("no decoder", func(t *testing.T) {
+		reg := NewDecoders()
+		if _, err := reg.Decode("a", "", []byte("{}")); err == nil {
+			t.Errorf("expected error with no decoders")
+		}
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		if d := DefaultDecoders.Find("a", "", []byte(`{"type": "Feature"}`)); d == nil || d.Name() != "wnm" {
+			t.Errorf("expected wnm decoder, got %v", d)
+		}
+		if d := DefaultDecoders.Find("a", "", []byte(`{"baseUrl": "x"}`)); d == nil || d.Name() != "gtstowis2" {
+			t.Errorf("expected gtstowis2 decoder, got %v", d)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// SeenStore records which messages have already been seen so duplicates can
+// be dropped, e.g., the same notification arriving via origin and cache topics.
+type SeenStore interface {
+	// Seen records keys as pending, returning true if any of them had already
+	// been seen, or are pending, and have not expired. Keys that are still
+	// pending when the store is reopened are not seen, so a message is not lost
+	// if the process exits before it is ingested.
+	Seen(keys ...string) (bool, error)
+	// Done records pending keys as seen once the message has been ingested.
+	Done(keys ...string) error
+	// Forget removes keys, e.g., if ingest failed and the message should be
+	// accepted if received again.
+	Forget(keys ...string) error
+	Close() error
+}
+
+// MessageKeys returns the keys used to deduplicate msg: the notification id,
+// the data_id and integrity, and, for messages without a data_id, the URL and
+// integrity.
+func MessageKeys(msg *Message) []string {
+	wis := msg.Payload
+	keys := []string{}
+	if wis.ID != "" {
+		keys = append(keys, "id:"+wis.ID)
+	}
+	integrity := wis.Integrity.Method + ":" + wis.Integrity.Value
+	switch {
+	case wis.DataID != "":
+		keys = append(keys, "data:"+wis.DataID+"|"+integrity)
+	case wis.URL() != "":
+		keys = append(keys, "url:"+wis.URL()+"|"+integrity)
+	}
+	return keys
+}
+
+var seenBucket = []byte("seen")
+
+// seenValue encodes an entry as its expiry time in Unix nanoseconds, followed
+// by a 1 if it is pending.
+func seenValue(expires time.Time, pending bool) []byte {
+	v := make([]byte, 9)
+	binary.BigEndian.PutUint64(v, uint64(expires.UnixNano()))
+	if pending {
+		v[8] = 1
+	}
+	return v
+}
+
+func seenPending(v []byte) bool {
+	return len(v) > 8 && v[8] == 1
+}
+
+// BoltSeenStore is a SeenStore persisted in a bbolt database. Entries expire
+// after a TTL.
+type BoltSeenStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewBoltSeenStore opens, or creates, the store at fpath. The store is locked
+// while open, so it may only be used by a single process.
+func NewBoltSeenStore(fpath string, ttl time.Duration) (*BoltSeenStore, error) {
+	db, err := bolt.Open(fpath, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", fpath, err)
+	}
+	// Pending entries are from messages that were not ingested before the store
+	// was last closed
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(seenBucket)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; {
+			if !seenPending(v) {
+				k, v = c.Next()
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			k, v = c.Seek(k)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltSeenStore{db: db, ttl: ttl, now: time.Now}, nil
+}
+
+func (s *BoltSeenStore) Seen(keys ...string) (bool, error) {
+	now := s.now()
+	seen := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		expires := seenValue(now.Add(s.ttl), true)
+		for _, key := range keys {
+			if v := b.Get([]byte(key)); v != nil && int64(binary.BigEndian.Uint64(v)) > now.UnixNano() {
+				seen = true
+				continue
+			}
+			if err := b.Put([]byte(key), expires); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return seen, err
+}
+
+func (s *BoltSeenStore) Done(keys ...string) error {
+	expires := seenValue(s.now().Add(s.ttl), false)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		for _, key := range keys {
+			if err := b.Put([]byte(key), expires); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltSeenStore) Forget(keys ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(seenBucket)
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Expire removes expired entries, returning the number removed.
+func (s *BoltSeenStore) Expire() (int, error) {
+	now := s.now().UnixNano()
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(seenBucket).Cursor()
+		for k, v := c.First(); k != nil; {
+			if int64(binary.BigEndian.Uint64(v)) > now {
+				k, v = c.Next()
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			count++
+			// Delete moves the cursor to the next item
+			k, v = c.Seek(k)
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *BoltSeenStore) Close() error {
+	return s.db.Close()
+}
+
+var _ SeenStore = (*BoltSeenStore)(nil)
+
+// MemorySeenStore is a SeenStore kept in memory. Entries expire after a TTL.
+type MemorySeenStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	expires   map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemorySeenStore(ttl time.Duration) *MemorySeenStore {
+	return &MemorySeenStore{ttl: ttl, expires: map[string]time.Time{}, lastSweep: time.Now(), now: time.Now}
+}
+
+func (s *MemorySeenStore) Seen(keys ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	// Sweep expired entries at most once per TTL to bound memory use
+	if now.Sub(s.lastSweep) > s.ttl {
+		for key, expires := range s.expires {
+			if !expires.After(now) {
+				delete(s.expires, key)
+			}
+		}
+		s.lastSweep = now
+	}
+	seen := false
+	for _, key := range keys {
+		if expires, ok := s.expires[key]; ok && expires.After(now) {
+			seen = true
+			continue
+		}
+		s.expires[key] = now.Add(s.ttl)
+	}
+	return seen, nil
+}
+
+// Done refreshes the expiry of keys. Entries are not kept across restarts, so
+// pending entries are otherwise the same as seen entries.
+func (s *MemorySeenStore) Done(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, key := range keys {
+		s.expires[key] = now.Add(s.ttl)
+	}
+	return nil
+}
+
+func (s *MemorySeenStore) Forget(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.expires, key)
+	}
+	return nil
+}
+
+func (s *MemorySeenStore) Close() error { return nil }
+
+var _ SeenStore = (*MemorySeenStore)(nil)
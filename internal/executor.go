@@ -3,15 +3,21 @@ package internal
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
 )
 
-type Executor func(ctx context.Context, name string, args ...string) error
+// Executor runs the command name with args. env contains additional environment
+// variables in the form key=value.
+type Executor func(ctx context.Context, env []string, name string, args ...string) error
 
-func RunScript(ctx context.Context, name string, args ...string) error {
+func RunScript(ctx context.Context, env []string, name string, args ...string) error {
 	if len(args) == 0 {
 		return fmt.Errorf("no args")
 	}
 	cmd := exec.CommandContext(ctx, name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	return cmd.Run()
 }
@@ -10,18 +10,23 @@ func TestRunScript(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := RunScript(ctx, "/bin/ls", ".")
+	err := RunScript(ctx, nil, "/bin/ls", ".")
 	if err != nil {
 		t.Errorf("Should succeed with full path to binary, got %+v", err)
 	}
 
-	err = RunScript(ctx, "ls", ".")
+	err = RunScript(ctx, nil, "ls", ".")
 	if err != nil {
 		t.Errorf("Should succeed with just binary name, got %s", err)
 	}
 
-	err = RunScript(ctx, ".......I.dont.exist", "arg", "arg")
+	err = RunScript(ctx, nil, ".......I.dont.exist", "arg", "arg")
 	if err == nil {
 		t.Errorf("Should fail for binary that doesn't exist, got %v", err)
 	}
+
+	err = RunScript(ctx, []string{"WIS2_TEST=yes"}, "sh", "-c", `test "$WIS2_TEST" = yes`)
+	if err != nil {
+		t.Errorf("Should pass env to command, got %s", err)
+	}
 }
@@ -44,6 +44,18 @@ func FindFetcher(url string) Fetcher {
 	return nil
 }
 
+// NewFetcherFactory returns a FetcherFactory like FindFetcher where HTTP
+// fetchers use the TLS configuration from p.
+func NewFetcherFactory(p *TLSProvider) FetcherFactory {
+	return func(url string) Fetcher {
+		f := FindFetcher(url)
+		if hf, ok := f.(*HTTPFetcher); ok {
+			hf.client.Transport = p.Transport()
+		}
+		return f
+	}
+}
+
 type CredentialGetter func(host string) (string, string, error)
 
 func newNetrcCredentialFactory(fpath string) CredentialGetter {
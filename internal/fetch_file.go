@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	_url "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileFetcher is a Fetcher for file:// URLs. Only files in one of Roots may be
+// fetched so notifications cannot be used to read arbitrary local files.
+type FileFetcher struct {
+	Roots []string
+}
+
+// allowed returns true if fpath is in one of the roots.
+func (f *FileFetcher) allowed(fpath string) bool {
+	for _, root := range f.Roots {
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FileFetcher) FetchContext(ctx context.Context, url string, dst io.Writer) error {
+	u, err := _url.Parse(url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") {
+		return fmt.Errorf("invalid file url")
+	}
+	fpath, err := filepath.EvalSymlinks(filepath.FromSlash(u.Path))
+	if err != nil {
+		return err
+	}
+	if !f.allowed(fpath) {
+		return fmt.Errorf("%s is not in an allowed directory", u.Path)
+	}
+
+	src, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (f *FileFetcher) Fetch(url string, dst io.Writer) error {
+	return f.FetchContext(context.Background(), url, dst)
+}
+
+// NewFileFetcherFactory returns a FetcherFactory that uses a FileFetcher for
+// files in roots and factory for all other URLs.
+func NewFileFetcherFactory(factory FetcherFactory, roots ...string) FetcherFactory {
+	fetcher := &FileFetcher{Roots: roots}
+	return func(url string) Fetcher {
+		if strings.HasPrefix(url, "file:") {
+			return fetcher
+		}
+		return factory(url)
+	}
+}
+
+var _ Fetcher = (*FileFetcher)(nil)
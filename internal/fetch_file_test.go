@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFetcher(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file.bufr"), []byte("data"), 0o644)
+	os.WriteFile(filepath.Join(other, "secret"), []byte("secret"), 0o644)
+	os.Symlink(filepath.Join(other, "secret"), filepath.Join(root, "link"))
+
+	fetcher := NewFileFetcherFactory(FindFetcher, root)("file://" + root + "/file.bufr")
+	buf := &bytes.Buffer{}
+	if err := fetcher.Fetch("file://"+root+"/file.bufr", buf); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if buf.String() != "data" {
+		t.Errorf("unexpected data %s", buf)
+	}
+
+	for _, url := range []string{
+		"file://" + other + "/secret",
+		"file://" + root + "/../" + filepath.Base(other) + "/secret",
+		"file://" + root + "/link",
+		"file://host" + root + "/file.bufr",
+	} {
+		if err := fetcher.Fetch(url, &bytes.Buffer{}); err == nil {
+			t.Errorf("%s: expected error", url)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package internal
+
+// Filter decides whether a received message should be ingested.
+type Filter interface {
+	// Accept returns nil if the message should be ingested, otherwise an error
+	// describing why it was rejected.
+	Accept(msg *Message) error
+}
@@ -0,0 +1,406 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type point [2]float64
+
+// shape is a GeoJSON geometry decomposed into its component parts.
+type shape struct {
+	points   []point
+	lines    [][]point
+	polygons [][][]point // outer ring followed by any holes
+}
+
+func (s *shape) add(o shape) {
+	s.points = append(s.points, o.points...)
+	s.lines = append(s.lines, o.lines...)
+	s.polygons = append(s.polygons, o.polygons...)
+}
+
+func (s shape) empty() bool {
+	return len(s.points) == 0 && len(s.lines) == 0 && len(s.polygons) == 0
+}
+
+// segments returns all line segments from lines and polygon rings.
+func (s shape) segments() [][2]point {
+	segs := [][2]point{}
+	addRing := func(ring []point) {
+		for i := 1; i < len(ring); i++ {
+			segs = append(segs, [2]point{ring[i-1], ring[i]})
+		}
+	}
+	for _, line := range s.lines {
+		addRing(line)
+	}
+	for _, poly := range s.polygons {
+		for _, ring := range poly {
+			addRing(ring)
+		}
+	}
+	return segs
+}
+
+// vertices returns all points, including line and polygon vertices.
+func (s shape) vertices() []point {
+	pts := append([]point{}, s.points...)
+	for _, line := range s.lines {
+		pts = append(pts, line...)
+	}
+	for _, poly := range s.polygons {
+		for _, ring := range poly {
+			pts = append(pts, ring...)
+		}
+	}
+	return pts
+}
+
+// contains returns true if pt is within, or on the boundary of, any polygon.
+func (s shape) contains(pt point) bool {
+	for _, poly := range s.polygons {
+		if len(poly) == 0 || !ringContains(poly[0], pt) {
+			continue
+		}
+		inHole := false
+		for _, hole := range poly[1:] {
+			if ringContains(hole, pt) && !onRing(hole, pt) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// intersects returns true if the shapes share any point.
+func (s shape) intersects(o shape) bool {
+	for _, pt := range s.vertices() {
+		if o.contains(pt) {
+			return true
+		}
+	}
+	for _, pt := range o.vertices() {
+		if s.contains(pt) {
+			return true
+		}
+	}
+	osegs := o.segments()
+	for _, a := range s.segments() {
+		for _, b := range osegs {
+			if segmentsIntersect(a[0], a[1], b[0], b[1]) {
+				return true
+			}
+		}
+	}
+	// Points that are not polygon vertices may still lie on lines
+	for _, pt := range s.points {
+		for _, seg := range osegs {
+			if orientation(seg[0], seg[1], pt) == 0 && onSegment(seg[0], seg[1], pt) {
+				return true
+			}
+		}
+	}
+	for _, pt := range o.points {
+		for _, seg := range s.segments() {
+			if orientation(seg[0], seg[1], pt) == 0 && onSegment(seg[0], seg[1], pt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func onRing(ring []point, pt point) bool {
+	for i := 1; i < len(ring); i++ {
+		if orientation(ring[i-1], ring[i], pt) == 0 && onSegment(ring[i-1], ring[i], pt) {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains uses ray casting to determine if pt is inside ring. Points on the
+// boundary are considered inside.
+func ringContains(ring []point, pt point) bool {
+	if onRing(ring, pt) {
+		return true
+	}
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > pt[1]) != (b[1] > pt[1]) &&
+			pt[0] < (b[0]-a[0])*(pt[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func orientation(a, b, c point) int {
+	v := (b[1]-a[1])*(c[0]-b[0]) - (b[0]-a[0])*(c[1]-b[1])
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// onSegment returns true if c, known to be colinear with a and b, lies on the
+// segment a-b.
+func onSegment(a, b, c point) bool {
+	return c[0] <= fmax(a[0], b[0]) && c[0] >= fmin(a[0], b[0]) &&
+		c[1] <= fmax(a[1], b[1]) && c[1] >= fmin(a[1], b[1])
+}
+
+func segmentsIntersect(p1, q1, p2, q2 point) bool {
+	o1 := orientation(p1, q1, p2)
+	o2 := orientation(p1, q1, q2)
+	o3 := orientation(p2, q2, p1)
+	o4 := orientation(p2, q2, q1)
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+	return (o1 == 0 && onSegment(p1, q1, p2)) ||
+		(o2 == 0 && onSegment(p1, q1, q2)) ||
+		(o3 == 0 && onSegment(p2, q2, p1)) ||
+		(o4 == 0 && onSegment(p2, q2, q1))
+}
+
+func fmax(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func fmin(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometries  []geometry      `json:"geometries"`
+}
+
+func toPoint(c []float64) (point, error) {
+	if len(c) < 2 {
+		return point{}, fmt.Errorf("invalid position %v", c)
+	}
+	return point{c[0], c[1]}, nil
+}
+
+func toPoints(cs [][]float64) ([]point, error) {
+	pts := make([]point, len(cs))
+	for i, c := range cs {
+		pt, err := toPoint(c)
+		if err != nil {
+			return nil, err
+		}
+		pts[i] = pt
+	}
+	return pts, nil
+}
+
+func toPolygon(rings [][][]float64) ([][]point, error) {
+	poly := make([][]point, len(rings))
+	for i, ring := range rings {
+		pts, err := toPoints(ring)
+		if err != nil {
+			return nil, err
+		}
+		poly[i] = pts
+	}
+	return poly, nil
+}
+
+func (g geometry) shape() (shape, error) {
+	s := shape{}
+	var err error
+	switch g.Type {
+	case "Point":
+		var c []float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			var pt point
+			pt, err = toPoint(c)
+			s.points = append(s.points, pt)
+		}
+	case "MultiPoint":
+		var cs [][]float64
+		if err = json.Unmarshal(g.Coordinates, &cs); err == nil {
+			s.points, err = toPoints(cs)
+		}
+	case "LineString":
+		var cs [][]float64
+		if err = json.Unmarshal(g.Coordinates, &cs); err == nil {
+			var pts []point
+			pts, err = toPoints(cs)
+			s.lines = append(s.lines, pts)
+		}
+	case "MultiLineString":
+		var cs [][][]float64
+		if err = json.Unmarshal(g.Coordinates, &cs); err == nil {
+			for _, line := range cs {
+				var pts []point
+				if pts, err = toPoints(line); err != nil {
+					break
+				}
+				s.lines = append(s.lines, pts)
+			}
+		}
+	case "Polygon":
+		var cs [][][]float64
+		if err = json.Unmarshal(g.Coordinates, &cs); err == nil {
+			var poly [][]point
+			poly, err = toPolygon(cs)
+			s.polygons = append(s.polygons, poly)
+		}
+	case "MultiPolygon":
+		var cs [][][][]float64
+		if err = json.Unmarshal(g.Coordinates, &cs); err == nil {
+			for _, rings := range cs {
+				var poly [][]point
+				if poly, err = toPolygon(rings); err != nil {
+					break
+				}
+				s.polygons = append(s.polygons, poly)
+			}
+		}
+	case "GeometryCollection":
+		for _, child := range g.Geometries {
+			var cs shape
+			if cs, err = child.shape(); err != nil {
+				break
+			}
+			s.add(cs)
+		}
+	default:
+		err = fmt.Errorf("unsupported geometry type '%s'", g.Type)
+	}
+	if err != nil {
+		return s, fmt.Errorf("invalid %s: %w", g.Type, err)
+	}
+	return s, nil
+}
+
+// parseGeometry parses a GeoJSON geometry, feature or feature collection.
+func parseGeometry(data []byte) (shape, error) {
+	var doc struct {
+		Type     string          `json:"type"`
+		Geometry json.RawMessage `json:"geometry"`
+		Features []struct {
+			Geometry json.RawMessage `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return shape{}, err
+	}
+	switch doc.Type {
+	case "Feature":
+		if len(doc.Geometry) == 0 || string(doc.Geometry) == "null" {
+			return shape{}, nil
+		}
+		return parseGeometry(doc.Geometry)
+	case "FeatureCollection":
+		s := shape{}
+		for _, f := range doc.Features {
+			if len(f.Geometry) == 0 || string(f.Geometry) == "null" {
+				continue
+			}
+			fs, err := parseGeometry(f.Geometry)
+			if err != nil {
+				return s, err
+			}
+			s.add(fs)
+		}
+		return s, nil
+	}
+	var g geometry
+	if err := json.Unmarshal(data, &g); err != nil {
+		return shape{}, err
+	}
+	return g.shape()
+}
+
+// GeoFilter is a Filter that only accepts messages with a geometry intersecting
+// a region.
+type GeoFilter struct {
+	region     shape
+	acceptNull bool
+}
+
+// NewBBoxFilter creates a GeoFilter for the bounding box. As in GeoJSON, a
+// bounding box with minx greater than maxx crosses the antimeridian.
+func NewBBoxFilter(minx, miny, maxx, maxy float64) (*GeoFilter, error) {
+	if miny > maxy {
+		return nil, fmt.Errorf("invalid bbox [%v, %v, %v, %v]", minx, miny, maxx, maxy)
+	}
+	ring := func(minx, maxx float64) [][]point {
+		return [][]point{{{minx, miny}, {maxx, miny}, {maxx, maxy}, {minx, maxy}, {minx, miny}}}
+	}
+	if minx > maxx {
+		// Split at the antimeridian
+		return &GeoFilter{region: shape{polygons: [][][]point{ring(minx, 180), ring(-180, maxx)}}}, nil
+	}
+	return &GeoFilter{region: shape{polygons: [][][]point{ring(minx, maxx)}}}, nil
+}
+
+// LoadGeoFilter creates a GeoFilter for the polygons in a GeoJSON file, which
+// may contain a geometry, feature or feature collection.
+func LoadGeoFilter(fpath string) (*GeoFilter, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	region, err := parseGeometry(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fpath, err)
+	}
+	if len(region.polygons) == 0 {
+		return nil, fmt.Errorf("no polygons in %s", fpath)
+	}
+	return &GeoFilter{region: shape{polygons: region.polygons}}, nil
+}
+
+// AcceptNull sets whether messages without a geometry are accepted.
+func (f *GeoFilter) AcceptNull(b bool) *GeoFilter {
+	f.acceptNull = b
+	return f
+}
+
+func (f *GeoFilter) Accept(msg *Message) error {
+	geom := msg.Payload.Geometry
+	if len(geom) == 0 || string(geom) == "null" {
+		if f.acceptNull {
+			return nil
+		}
+		return fmt.Errorf("geometry is null")
+	}
+	s, err := parseGeometry(geom)
+	if err != nil {
+		return fmt.Errorf("invalid geometry: %w", err)
+	}
+	if s.empty() {
+		if f.acceptNull {
+			return nil
+		}
+		return fmt.Errorf("geometry is empty")
+	}
+	if !s.intersects(f.region) {
+		return fmt.Errorf("geometry does not intersect region")
+	}
+	return nil
+}
+
+var _ Filter = (*GeoFilter)(nil)
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoFilter(t *testing.T) {
+	bbox, err := NewBBoxFilter(-10, -10, 10, 10)
+	if err != nil {
+		t.Fatalf("failed to create bbox filter: %s", err)
+	}
+
+	tests := []struct {
+		Name     string
+		Geometry string
+		Accept   bool
+	}{
+		{"point inside", `{"type": "Point", "coordinates": [1, 1]}`, true},
+		{"point outside", `{"type": "Point", "coordinates": [20, 20]}`, false},
+		{"point on edge", `{"type": "Point", "coordinates": [10, 0, 100]}`, true},
+		{"line crossing", `{"type": "LineString", "coordinates": [[-20, 0], [20, 0]]}`, true},
+		{"line outside", `{"type": "LineString", "coordinates": [[-20, 20], [20, 20]]}`, false},
+		{"polygon containing region", `{"type": "Polygon", "coordinates": [[[-50, -50], [50, -50], [50, 50], [-50, 50], [-50, -50]]]}`, true},
+		{"polygon overlapping", `{"type": "Polygon", "coordinates": [[[5, 5], [50, 5], [50, 50], [5, 50], [5, 5]]]}`, true},
+		{"polygon outside", `{"type": "Polygon", "coordinates": [[[15, 15], [50, 15], [50, 50], [15, 50], [15, 15]]]}`, false},
+		{"multipolygon", `{"type": "MultiPolygon", "coordinates": [[[[15, 15], [50, 15], [50, 50], [15, 15]]], [[[0, 0], [1, 0], [1, 1], [0, 0]]]]}`, true},
+		{"collection", `{"type": "GeometryCollection", "geometries": [{"type": "Point", "coordinates": [20, 20]}, {"type": "Point", "coordinates": [0, 0]}]}`, true},
+		{"null", `null`, false},
+		{"missing", ``, false},
+		{"invalid", `{"type": "Blob"}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := &Message{Payload: WISMessage{Geometry: []byte(test.Geometry)}}
+			err := bbox.Accept(msg)
+			if test.Accept && err != nil {
+				t.Errorf("expected accept, got %s", err)
+			}
+			if !test.Accept && err == nil {
+				t.Errorf("expected reject")
+			}
+		})
+	}
+
+	t.Run("accept null", func(t *testing.T) {
+		f, _ := NewBBoxFilter(-10, -10, 10, 10)
+		f.AcceptNull(true)
+		if err := f.Accept(&Message{}); err != nil {
+			t.Errorf("expected null geometry to be accepted, got %s", err)
+		}
+	})
+
+	t.Run("invalid bbox", func(t *testing.T) {
+		if _, err := NewBBoxFilter(-10, 10, 10, -10); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("antimeridian bbox", func(t *testing.T) {
+		f, err := NewBBoxFilter(170, -10, -170, 10)
+		if err != nil {
+			t.Fatalf("failed to create bbox filter: %s", err)
+		}
+		tests := []struct {
+			Geometry string
+			Accept   bool
+		}{
+			{`{"type": "Point", "coordinates": [175, 0]}`, true},
+			{`{"type": "Point", "coordinates": [-175, 0]}`, true},
+			{`{"type": "Point", "coordinates": [180, 0]}`, true},
+			{`{"type": "Point", "coordinates": [0, 0]}`, false},
+			{`{"type": "Point", "coordinates": [160, 0]}`, false},
+			{`{"type": "Point", "coordinates": [175, 20]}`, false},
+		}
+		for _, test := range tests {
+			msg := &Message{Payload: WISMessage{Geometry: []byte(test.Geometry)}}
+			if err := f.Accept(msg); (err == nil) != test.Accept {
+				t.Errorf("%s: expected accept=%v, got %v", test.Geometry, test.Accept, err)
+			}
+		}
+	})
+
+	t.Run("load polygon with hole", func(t *testing.T) {
+		fpath := filepath.Join(t.TempDir(), "region.geojson")
+		body := `{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {}, "geometry":
+			{"type": "Polygon", "coordinates": [
+				[[-10, -10], [10, -10], [10, 10], [-10, 10], [-10, -10]],
+				[[-5, -5], [5, -5], [5, 5], [-5, 5], [-5, -5]]
+			]}}]}`
+		if err := os.WriteFile(fpath, []byte(body), 0o644); err != nil {
+			t.Fatalf("failed to write region: %s", err)
+		}
+		f, err := LoadGeoFilter(fpath)
+		if err != nil {
+			t.Fatalf("failed to load filter: %s", err)
+		}
+		if err := f.Accept(&Message{Payload: WISMessage{Geometry: []byte(`{"type": "Point", "coordinates": [0, 0]}`)}}); err == nil {
+			t.Errorf("expected point in hole to be rejected")
+		}
+		if err := f.Accept(&Message{Payload: WISMessage{Geometry: []byte(`{"type": "Point", "coordinates": [7, 7]}`)}}); err != nil {
+			t.Errorf("expected point in polygon to be accepted, got %s", err)
+		}
+	})
+}
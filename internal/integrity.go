@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// hashes are the supported integrity methods, which include those allowed by the
+// WIS2 Notification Message specification, plus md5 for legacy messages.
+var hashes = map[string]func() hash.Hash{
+	"md5":      md5.New,
+	"sha256":   sha256.New,
+	"sha384":   sha512.New384,
+	"sha512":   sha512.New,
+	"sha3-256": sha3.New256,
+	"sha3-384": sha3.New384,
+	"sha3-512": sha3.New512,
+}
+
+// IntegrityMethods returns the names of the supported integrity methods.
+func IntegrityMethods() []string {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewHash returns a new hash for the integrity method.
+func NewHash(method string) (hash.Hash, error) {
+	newHash, ok := hashes[strings.ToLower(method)]
+	if !ok {
+		return nil, fmt.Errorf("unknown integrity method '%s', expected one of %s",
+			method, strings.Join(IntegrityMethods(), ", "))
+	}
+	return newHash(), nil
+}
+
+// DecodeDigest decodes an integrity value for method to the raw digest. Values
+// may be hex encoded, base64 encoded or the base64 encoding of the hex encoded
+// digest, as used by some legacy publishers.
+func DecodeDigest(method, value string) ([]byte, error) {
+	h, err := NewHash(method)
+	if err != nil {
+		return nil, err
+	}
+	size := h.Size()
+	value = strings.TrimSpace(value)
+
+	// Values consisting only of hex digits are treated as hex, as they are very
+	// unlikely to be base64
+	if digest, err := hex.DecodeString(value); err == nil {
+		if len(digest) == size {
+			return digest, nil
+		}
+		return nil, fmt.Errorf("invalid %s: %s", method, value)
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		buf, err := enc.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		if len(buf) == size {
+			return buf, nil
+		}
+		if len(buf) == size*2 {
+			if digest, err := hex.DecodeString(string(buf)); err == nil {
+				return digest, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("invalid %s: %s", method, value)
+}
+
+// normalizeIntegrity returns integrity with a lower case method and the value
+// hex encoded. If the value cannot be decoded it is returned as-is so the error
+// can be reported when the message is validated.
+func normalizeIntegrity(integrity Integrity) Integrity {
+	integrity.Method = strings.ToLower(integrity.Method)
+	if digest, err := DecodeDigest(integrity.Method, integrity.Value); err == nil {
+		integrity.Value = hex.EncodeToString(digest)
+	}
+	return integrity
+}
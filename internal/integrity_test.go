@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"testing"
+)
+
+func TestDecodeDigest(t *testing.T) {
+	// digests of 'hello'
+	sha3_256 := "3338be694f50c5f338814986cdf0686453a888b84f424d792af4b9202398f392"
+	sha384 := "59e1748777448c69de6b800d7a33bbfb9ff1b463e44354c3553bcdb9c666fa90125a3c79f90397bdf5f6a13de828684f"
+	raw := func(s string) []byte {
+		buf, _ := hex.DecodeString(s)
+		return buf
+	}
+
+	tests := []struct {
+		Name     string
+		Method   string
+		Value    string
+		Expected string
+		ErrPat   string
+	}{
+		{"hex", "sha3-256", sha3_256, sha3_256, ""},
+		{"upper case method", "SHA384", sha384, sha384, ""},
+		{"base64", "sha3-256", base64.StdEncoding.EncodeToString(raw(sha3_256)), sha3_256, ""},
+		{"unpadded base64", "sha384", base64.RawStdEncoding.EncodeToString(raw(sha384)), sha384, ""},
+		{"base64 of hex", "sha3-256", base64.StdEncoding.EncodeToString([]byte(sha3_256)), sha3_256, ""},
+		{"wrong length", "sha384", sha3_256, "", "invalid sha384"},
+		{"garbage", "sha3-256", "not a digest!", "", "invalid sha3-256"},
+		{"unknown method", "crc32", "ffffffff", "", "unknown integrity method 'crc32'"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got, err := DecodeDigest(test.Method, test.Value)
+			if test.ErrPat != "" {
+				if err == nil || !regexp.MustCompile(test.ErrPat).MatchString(err.Error()) {
+					t.Errorf("expected error matching %s, got %v", test.ErrPat, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if hex.EncodeToString(got) != test.Expected {
+				t.Errorf("expected %s, got %x", test.Expected, got)
+			}
+		})
+	}
+}
+
+func TestNewHash(t *testing.T) {
+	for _, method := range IntegrityMethods() {
+		h, err := NewHash(method)
+		if err != nil {
+			t.Errorf("expected hash for %s, got %s", method, err)
+			continue
+		}
+		h.Write([]byte("hello"))
+		if len(h.Sum(nil)) != h.Size() {
+			t.Errorf("unexpected digest size for %s", method)
+		}
+	}
+}
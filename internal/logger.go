@@ -13,7 +13,7 @@ type Logger struct {
 
 func NewLogger(debug bool) *Logger {
 	l := &Logger{debug: debug, loggers: map[string]*log.Logger{}}
-	for _, lvl := range []string{"info ", "error", "debug"} {
+	for _, lvl := range []string{"info ", "warn ", "error", "debug"} {
 		l.loggers[strings.TrimSpace(lvl)] = log.New(os.Stderr, "["+strings.ToUpper(lvl)+"] ", log.LstdFlags)
 	}
 	return l
@@ -28,6 +28,7 @@ func (l *Logger) log(lvl, fmt string, args ...interface{}) {
 }
 
 func (l *Logger) Info(fmt string, args ...interface{})  { l.log("info", fmt, args...) }
+func (l *Logger) Warn(fmt string, args ...interface{})  { l.log("warn", fmt, args...) }
 func (l *Logger) Error(fmt string, args ...interface{}) { l.log("error", fmt, args...) }
 func (l *Logger) Debug(fmt string, args ...interface{}) {
 	if l != nil && l.debug {
@@ -1,30 +1,145 @@
 package internal
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"path"
-	"regexp"
 	"time"
 )
 
-var supportedIntegrities = regexp.MustCompile(`^(?:md5|sha256|sha512)$`)
-
 type Integrity struct {
 	Method string `json:"method"`
 	Value  string `json:"value"`
 }
 
+// Link is a WIS2 Notification Message link.
+type Link struct {
+	Href   string `json:"href"`
+	Rel    string `json:"rel,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// Content is data included inline in a WIS2 Notification Message.
+type Content struct {
+	// Encoding is one of utf-8, base64 or gzip, where gzip content is also
+	// base64 encoded.
+	Encoding string `json:"encoding"`
+	Value    string `json:"value"`
+	// Size is the size of the decoded content in bytes.
+	Size int64 `json:"size"`
+}
+
+// Data returns the decoded content.
+func (c Content) Data() ([]byte, error) {
+	switch c.Encoding {
+	case "utf-8", "utf8", "":
+		return []byte(c.Value), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(c.Value)
+	case "gzip":
+		buf, err := base64.StdEncoding.DecodeString(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", c.Encoding)
+	}
+}
+
+// WISMessage is the common notification model shared by all supported message
+// formats. Legacy GTStoWIS2 messages populate BaseURL and RelPath (or RetPath),
+// WIS2 Notification Messages populate ID, DataID and Links.
 type WISMessage struct {
-	PubTime   *time.Time `json:"pubTime"`
-	BaseURL   string     `json:"baseUrl"`
-	RelPath   string     `json:"relPath"`
+	PubTime   *time.Time `json:"pubTime,omitempty"`
+	BaseURL   string     `json:"baseUrl,omitempty"`
+	RelPath   string     `json:"relPath,omitempty"`
 	Integrity Integrity  `json:"integrity"`
-	Size      int64      `json:"size"`
-	RetPath   string     `json:"retPath"`
+	Size      int64      `json:"size,omitempty"`
+	RetPath   string     `json:"retPath,omitempty"`
+
+	ID         string          `json:"id,omitempty"`
+	DataID     string          `json:"data_id,omitempty"`
+	MetadataID string          `json:"metadata_id,omitempty"`
+	Links      []Link          `json:"links,omitempty"`
+	Geometry   json.RawMessage `json:"geometry,omitempty"`
+	Content    *Content        `json:"content,omitempty"`
+}
+
+// Action is what a notification indicates should be done with the data it
+// references.
+type Action string
+
+const (
+	ActionNew    Action = "new"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Link relations with special meaning for data links.
+const (
+	RelCanonical = "canonical"
+	RelUpdate    = "update"
+	RelDeletion  = "deletion"
+)
+
+// Action returns the action indicated by the message links. Messages with a
+// deletion link are deletes, messages with an update link are updates and all
+// others are new data.
+func (msg WISMessage) Action() Action {
+	action := ActionNew
+	for _, l := range msg.Links {
+		switch l.Rel {
+		case RelDeletion:
+			return ActionDelete
+		case RelUpdate:
+			action = ActionUpdate
+		}
+	}
+	return action
+}
+
+// DataLink returns the link for the data referenced by the message, or nil if
+// there are no links. Preference is given to canonical, update and deletion
+// links, in that order, otherwise the first link is used.
+func (msg WISMessage) DataLink() *Link {
+	var first *Link
+	for _, rel := range []string{RelCanonical, RelUpdate, RelDeletion} {
+		for i := range msg.Links {
+			l := &msg.Links[i]
+			if l.Href == "" {
+				continue
+			}
+			if l.Rel == rel {
+				return l
+			}
+			if first == nil {
+				first = l
+			}
+		}
+	}
+	return first
 }
 
 func (msg WISMessage) URL() string {
+	if msg.BaseURL == "" && msg.RelPath == "" && msg.RetPath == "" {
+		if l := msg.DataLink(); l != nil {
+			return l.Href
+		}
+		return ""
+	}
 	relpath := msg.RelPath
 	if relpath == "" {
 		relpath = msg.RetPath
@@ -36,28 +151,112 @@ func (msg WISMessage) URL() string {
 	return u.String()
 }
 
+// Name returns the base name of the file referenced by the message, or an empty
+// string if it cannot be determined.
+func (msg WISMessage) Name() string {
+	u, err := url.Parse(msg.URL())
+	if err != nil || u.Path == "" {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// InlineData returns the data included in the message, if any. Data is only
+// returned if it can be decoded and is not truncated, i.e., it is the size
+// advertised by the message.
+func (msg WISMessage) InlineData() ([]byte, bool) {
+	if msg.Content == nil {
+		return nil, false
+	}
+	data, err := msg.Content.Data()
+	if err != nil || int64(len(data)) != msg.Content.Size {
+		return nil, false
+	}
+	return data, true
+}
+
 func (msg WISMessage) IsValid() error {
 	if msg.URL() == "" {
 		return fmt.Errorf("unable to construct URL")
 	}
-	if !supportedIntegrities.MatchString(msg.Integrity.Method) {
-		return fmt.Errorf("unsupported integrity alg '%s'", msg.Integrity.Method)
+	if msg.Name() == "" {
+		return fmt.Errorf("unable to determine file name from URL")
+	}
+	// Integrity is optional in WIS2 Notification Messages
+	if msg.Integrity == (Integrity{}) {
+		return nil
+	}
+	h, err := NewHash(msg.Integrity.Method)
+	if err != nil {
+		return fmt.Errorf("unsupported integrity alg '%s': %w", msg.Integrity.Method, err)
 	}
-	switch {
-	case msg.Integrity.Method == "sha512" && len(msg.Integrity.Value) != 128:
-		return fmt.Errorf("invalid sha512: %s", msg.Integrity.Value)
-	case msg.Integrity.Method == "sha256" && len(msg.Integrity.Value) != 64:
-		return fmt.Errorf("invalid sha256: %s", msg.Integrity.Value)
-	case msg.Integrity.Method == "md5" && len(msg.Integrity.Value) != 32:
+	if _, err := hex.DecodeString(msg.Integrity.Value); err != nil || len(msg.Integrity.Value) != h.Size()*2 {
 		return fmt.Errorf("invalid %s: %s", msg.Integrity.Method, msg.Integrity.Value)
 	}
 	return nil
 }
 
-// WIS is the message as defined in https://github.com/wmo-im/GTStoWIS2/tree/main/message_format
+// Message is a received notification. The payload is decoded from either the
+// legacy message format defined in https://github.com/wmo-im/GTStoWIS2/tree/main/message_format
+// or a WIS2 Notification Message as defined in https://github.com/wmo-im/wis2-notification-message.
 type Message struct {
 	Topic    string
 	Received time.Time
 	Source   string
 	Payload  WISMessage
+	// Format is the name of the Decoder used to decode the payload.
+	Format string
+	// Raw is the message body as received.
+	Raw []byte
+
+	// ack, if set by the receiver, acknowledges the message to its source. ok is
+	// false if the message could not be processed.
+	ack func(ok bool) error
+}
+
+// SetAck sets the function used by Ack and Nack to acknowledge the message to
+// its source.
+func (m *Message) SetAck(fn func(ok bool) error) {
+	m.ack = fn
+}
+
+// Ack acknowledges the message has been processed so the source will not
+// redeliver it. It does nothing if the receiver does not support
+// acknowledgement.
+func (m *Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack(true)
+}
+
+// Nack indicates the message could not be processed. Sources that support it
+// may redeliver the message, however MQTT has no negative acknowledgement so
+// MQTT messages are acknowledged.
+func (m *Message) Nack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack(false)
+}
+
+// WNMessage is a WIS2 Notification Message, a GeoJSON feature, as defined in
+// https://github.com/wmo-im/wis2-notification-message.
+type WNMessage struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	ConformsTo []string        `json:"conformsTo"`
+	Geometry   json.RawMessage `json:"geometry"`
+	Properties struct {
+		DataID     string     `json:"data_id"`
+		MetadataID string     `json:"metadata_id"`
+		PubTime    *time.Time `json:"pubtime"`
+		Integrity  *Integrity `json:"integrity"`
+		Content    *Content   `json:"content"`
+	} `json:"properties"`
+	Links []Link `json:"links"`
 }
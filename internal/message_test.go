@@ -21,8 +21,12 @@ func TestMessage(t *testing.T) {
 			{"sha256", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"sha512", fixtureSha512}}, ""},
 			{"sha512", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"sha256", fixtureSha256}}, ""},
 			{"md5", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"md5", fixtureMd5}}, ""},
+			{"sha3-512", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"sha3-512", fixtureSha512}}, ""},
+			{"sha384", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"sha384", fixtureSha512[:96]}}, ""},
+			{"unknown integrity is error", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"crc32", "ffffffff"}}, `unknown integrity method`},
 			{"works with retpath", WISMessage{BaseURL: "http://foo", RetPath: "/goo", Integrity: Integrity{"md5", fixtureMd5}}, ""},
-			{"missing integrity is error", WISMessage{BaseURL: "http://foo", RelPath: "/goo"}, `unsupported integrity`},
+			{"missing integrity", WISMessage{BaseURL: "http://foo", RelPath: "/goo"}, ""},
+			{"missing integrity method is error", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"", fixtureMd5}}, `unsupported integrity`},
 			{"invalid integrity is error", WISMessage{BaseURL: "http://foo", RelPath: "/goo", Integrity: Integrity{"md5", "xx"}}, `invalid md5`},
 		}
 
@@ -42,3 +46,66 @@ func TestMessage(t *testing.T) {
 		}
 	})
 }
+
+func TestContent(t *testing.T) {
+	// base64 of gzipped "hello"
+	gzipped := "H4sIAAAAAAAA/8pIzcnJBwQAAP//hqYQNgUAAAA="
+
+	tests := []struct {
+		Name     string
+		Content  Content
+		Expected string
+		Inline   bool
+	}{
+		{"utf-8", Content{"utf-8", "hello", 5}, "hello", true},
+		{"base64", Content{"base64", "aGVsbG8=", 5}, "hello", true},
+		{"gzip", Content{"gzip", gzipped, 5}, "hello", true},
+		{"truncated", Content{"utf-8", "hel", 5}, "hel", false},
+		{"unsupported encoding", Content{"rot13", "hello", 5}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			data, ok := WISMessage{Content: &test.Content}.InlineData()
+			if ok != test.Inline {
+				t.Fatalf("expected inline=%v, got %v", test.Inline, ok)
+			}
+			if ok && string(data) != test.Expected {
+				t.Errorf("expected %s, got %s", test.Expected, data)
+			}
+		})
+	}
+
+	t.Run("no content", func(t *testing.T) {
+		if _, ok := (WISMessage{}).InlineData(); ok {
+			t.Errorf("expected no inline data")
+		}
+	})
+}
+
+func TestMessageLinks(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Links    []Link
+		Action   Action
+		Expected string
+	}{
+		{"no links", nil, ActionNew, ""},
+		{"canonical", []Link{{Href: "http://x/via", Rel: "via"}, {Href: "http://x/a", Rel: "canonical"}}, ActionNew, "http://x/a"},
+		{"first link without canonical", []Link{{Href: "http://x/a"}, {Href: "http://x/b"}}, ActionNew, "http://x/a"},
+		{"update", []Link{{Href: "http://x/via", Rel: "via"}, {Href: "http://x/a", Rel: "update"}}, ActionUpdate, "http://x/a"},
+		{"deletion", []Link{{Href: "http://x/a", Rel: "deletion"}}, ActionDelete, "http://x/a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := WISMessage{Links: test.Links}
+			if msg.Action() != test.Action {
+				t.Errorf("expected action %s, got %s", test.Action, msg.Action())
+			}
+			if msg.URL() != test.Expected {
+				t.Errorf("expected url %s, got %s", test.Expected, msg.URL())
+			}
+		})
+	}
+}
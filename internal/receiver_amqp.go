@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	_url "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type AMQPReceiverOpt func(*AMQPReceiver)
+
+// WithAMQPExchange sets the exchange the queue is bound to. The default is
+// xpublic, the exchange used by Sarracenia brokers.
+func WithAMQPExchange(name string) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.exchange = name
+	}
+}
+
+// WithAMQPQueue sets the name of a durable queue so messages published while
+// disconnected are received after reconnecting. By default an exclusive queue
+// is used that is deleted when the connection is closed.
+func WithAMQPQueue(name string) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.queue = name
+	}
+}
+
+// WithAMQPBindingKeys sets the keys used to bind the queue to the exchange
+// instead of keys derived from the topics.
+func WithAMQPBindingKeys(keys ...string) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.bindingKeys = keys
+	}
+}
+
+// WithAMQPPrefetch sets the maximum number of unacknowledged messages the
+// broker will deliver. The default is 1.
+func WithAMQPPrefetch(n int) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.prefetch = n
+	}
+}
+
+// WithAMQPTLSProvider uses the current configuration from p for each amqps://
+// connection so reloaded certificates are used when reconnecting.
+func WithAMQPTLSProvider(p *TLSProvider) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.tlsConfig = p.Config
+	}
+}
+
+// WithAMQPEnvCredentials uses credentials from the <pfx>_USER and <pfx>_PASSWD
+// environment variables, if set, instead of any in the broker URL. Variables
+// set for later prefixes take precedence if used more than once.
+func WithAMQPEnvCredentials(pfx string) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		if v, ok := os.LookupEnv(pfx + "_USER"); ok {
+			r.user = v
+		}
+		if v, ok := os.LookupEnv(pfx + "_PASSWD"); ok {
+			r.passwd = v
+		}
+	}
+}
+
+// WithAMQPDecoders sets the decoders used to decode received messages. The
+// default is DefaultDecoders.
+func WithAMQPDecoders(decoders *Decoders) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.decoders = decoders
+	}
+}
+
+// WithAMQPRecorder records every message received, before it is decoded.
+func WithAMQPRecorder(recorder *Recorder) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.recorder = recorder
+	}
+}
+
+// WithAMQPConnectRetry keeps retrying the initial connection in the background
+// if it fails rather than NewAMQPReceiver returning an error.
+func WithAMQPConnectRetry(retry bool) AMQPReceiverOpt {
+	return func(r *AMQPReceiver) {
+		r.connectRetry = retry
+	}
+}
+
+// IsAMQPURL returns true if url is an amqp:// or amqps:// URL.
+func IsAMQPURL(url string) bool {
+	return strings.HasPrefix(url, "amqp://") || strings.HasPrefix(url, "amqps://")
+}
+
+// amqpBindingKey converts an MQTT topic filter to an AMQP topic exchange
+// binding key.
+func amqpBindingKey(topic string) string {
+	parts := strings.Split(topic, "/")
+	for i, p := range parts {
+		if p == "+" {
+			parts[i] = "*"
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// amqpTopic converts an AMQP routing key to an MQTT style topic.
+func amqpTopic(routingKey string) string {
+	return strings.ReplaceAll(routingKey, ".", "/")
+}
+
+// AMQPReceiver is a Receiver for an AMQP 0-9-1 broker. Messages are consumed
+// from a queue bound to a topic exchange. Like MQTTReceiver, lost connections
+// are re-established with exponential backoff.
+type AMQPReceiver struct {
+	log *log.Logger
+	ctx context.Context
+
+	url          string
+	source       string
+	exchange     string
+	queue        string
+	bindingKeys  []string
+	prefetch     int
+	user, passwd string
+	connectRetry bool
+	tlsConfig    func() *tls.Config
+	decoders     *Decoders
+	recorder     *Recorder
+
+	connState
+
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	lost       chan error
+	deliveries chan amqp.Delivery
+	cur        *Message
+	err        error
+}
+
+// NewAMQPReceiver connects to the broker at brokerURL and consumes messages
+// for topics, which are converted to binding keys by replacing / with . and +
+// with *. An error is returned if the initial connection fails, unless
+// WithAMQPConnectRetry is used, after which the connection is maintained until
+// ctx is canceled, at which point Next will return false.
+func NewAMQPReceiver(ctx context.Context, brokerURL string, topics []string, opts ...AMQPReceiverOpt) (*AMQPReceiver, error) {
+	u, err := _url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	recv := &AMQPReceiver{
+		log:      log.New(os.Stdout, "[broker] ", log.LstdFlags),
+		ctx:      ctx,
+		url:      brokerURL,
+		source:   u.Redacted(),
+		exchange: "xpublic",
+		prefetch: 1,
+		decoders: DefaultDecoders,
+		// nil uses the default TLS configuration
+		tlsConfig:  func() *tls.Config { return nil },
+		lost:       make(chan error, 1),
+		deliveries: make(chan amqp.Delivery),
+	}
+	for _, topic := range topics {
+		recv.bindingKeys = append(recv.bindingKeys, amqpBindingKey(topic))
+	}
+	for _, o := range opts {
+		o(recv)
+	}
+
+	if err := recv.connectAndConsume(); err != nil {
+		if !recv.connectRetry {
+			return nil, err
+		}
+		recv.lost <- err
+	}
+	go maintain(ctx, recv.log, recv.source, &recv.connState, recv.lost, recv.connectAndConsume, recv.disconnect)
+
+	return recv, nil
+}
+
+func (r *AMQPReceiver) connectAndConsume() error {
+	r.setState(Connecting)
+	cfg := amqp.Config{
+		TLSClientConfig: r.tlsConfig(),
+		Heartbeat:       10 * time.Second,
+	}
+	if r.user != "" {
+		cfg.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: r.user, Password: r.passwd}}
+	}
+	conn, err := amqp.DialConfig(r.url, cfg)
+	if err != nil {
+		r.setState(Disconnected)
+		return fmt.Errorf("connecting: %w", err)
+	}
+	if err := r.consume(conn); err != nil {
+		conn.Close()
+		r.setState(Disconnected)
+		return err
+	}
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+	r.setState(Connected)
+	r.log.Printf("connected to %s", r.source)
+	return nil
+}
+
+func (r *AMQPReceiver) consume(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("opening channel: %w", err)
+	}
+	if err := ch.Qos(r.prefetch, 0, false); err != nil {
+		return fmt.Errorf("setting prefetch: %w", err)
+	}
+	var q amqp.Queue
+	if r.queue != "" {
+		q, err = ch.QueueDeclare(r.queue, true, false, false, false, nil)
+	} else {
+		q, err = ch.QueueDeclare("", false, true, true, false, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("declaring queue: %w", err)
+	}
+	for _, key := range r.bindingKeys {
+		if err := ch.QueueBind(q.Name, key, r.exchange, false, nil); err != nil {
+			return fmt.Errorf("binding %s to exchange %s: %w", key, r.exchange, err)
+		}
+	}
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("consuming from %s: %w", q.Name, err)
+	}
+	go r.forward(deliveries, ch.NotifyClose(make(chan *amqp.Error, 1)))
+	return nil
+}
+
+// forward sends deliveries to Next until the channel is closed, at which point
+// maintain is notified the connection was lost.
+func (r *AMQPReceiver) forward(deliveries <-chan amqp.Delivery, closed chan *amqp.Error) {
+	for d := range deliveries {
+		select {
+		case r.deliveries <- d:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+	var err error = errors.New("channel closed")
+	if e := <-closed; e != nil {
+		err = e
+	}
+	if r.ctx.Err() != nil {
+		return
+	}
+	select {
+	case r.lost <- err:
+	default:
+	}
+}
+
+func (r *AMQPReceiver) disconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.setState(Disconnected)
+}
+
+// amqpAck returns a function to acknowledge d. Messages that could not be
+// processed are requeued to be redelivered once. If they fail again they are
+// rejected, and dead-lettered if the queue has a dead letter exchange, rather
+// than being redelivered forever if the failure is permanent, e.g., the data
+// no longer exists or does not match its integrity.
+func amqpAck(d amqp.Delivery) func(bool) error {
+	return func(ok bool) error {
+		var err error
+		if ok {
+			err = d.Ack(false)
+		} else {
+			err = d.Nack(false, !d.Redelivered)
+		}
+		if errors.Is(err, amqp.ErrClosed) {
+			// The connection was lost since it was received, so it will be redelivered
+			return nil
+		}
+		return err
+	}
+}
+
+func (r *AMQPReceiver) Message() *Message { return r.cur }
+func (r *AMQPReceiver) Err() error        { return r.err }
+func (r *AMQPReceiver) Next() bool {
+	for {
+		var d amqp.Delivery
+		select {
+		case d = <-r.deliveries:
+		case <-r.ctx.Done():
+			r.cur = nil
+			return false
+		}
+		topic := amqpTopic(d.RoutingKey)
+		if r.recorder != nil {
+			rec := NewRecord(r.source, topic, d.Body)
+			if d.ContentType != "" {
+				rec.Properties = &RecordProperties{ContentType: d.ContentType}
+			}
+			record(r.log, r.recorder, rec)
+		}
+		msg, err := r.decoders.Decode(topic, d.ContentType, d.Body)
+		if err != nil {
+			// A bad message should not stop message consumption, and will never
+			// decode so it is not requeued
+			r.log.Printf("failed to decode message on topic '%s': %s", topic, err)
+			d.Reject(false)
+			continue
+		}
+		msg.Source = r.source
+		msg.ack = amqpAck(d)
+		r.cur = msg
+		return true
+	}
+}
+
+var _ StatefulReceiver = (*AMQPReceiver)(nil)
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestAMQPBindingKey(t *testing.T) {
+	tests := []struct {
+		Topic    string
+		Expected string
+	}{
+		{"origin/a/wis2/#", "origin.a.wis2.#"},
+		{"origin/a/wis2/+/data/core/weather/#", "origin.a.wis2.*.data.core.weather.#"},
+		{"a/b+/c", "a.b+.c"},
+	}
+	for _, test := range tests {
+		if key := amqpBindingKey(test.Topic); key != test.Expected {
+			t.Errorf("%s: expected %s, got %s", test.Topic, test.Expected, key)
+		}
+	}
+	if topic := amqpTopic("origin.a.wis2.ca"); topic != "origin/a/wis2/ca" {
+		t.Errorf("unexpected topic %s", topic)
+	}
+}
+
+// fakeAcknowledger records the acknowledgement of deliveries.
+type fakeAcknowledger struct {
+	acks     []uint64
+	requeued []uint64
+	rejected []uint64
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	} else {
+		a.rejected = append(a.rejected, tag)
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestAMQPReceiverAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv := &AMQPReceiver{
+		log:        log.New(os.Stdout, "[broker] ", log.LstdFlags),
+		ctx:        ctx,
+		source:     "amqp://broker",
+		decoders:   DefaultDecoders,
+		deliveries: make(chan amqp.Delivery),
+	}
+	acker := &fakeAcknowledger{}
+	delivery := func(tag uint64, body string) amqp.Delivery {
+		return amqp.Delivery{
+			Acknowledger: acker,
+			DeliveryTag:  tag,
+			RoutingKey:   "a.b",
+			Body:         []byte(body),
+		}
+	}
+	go func() {
+		recv.deliveries <- delivery(1, "not json")
+		recv.deliveries <- delivery(2, `{"baseUrl": "https://host", "relPath": "/file.bufr"}`)
+		recv.deliveries <- delivery(3, `{"baseUrl": "https://host", "relPath": "/file.bufr"}`)
+		redelivered := delivery(4, `{"baseUrl": "https://host", "relPath": "/file.bufr"}`)
+		redelivered.Redelivered = true
+		recv.deliveries <- redelivered
+	}()
+
+	for tag := 2; tag <= 4; tag++ {
+		if !recv.Next() {
+			t.Fatalf("expected a message")
+		}
+		msg := recv.Message()
+		if msg.Topic != "a/b" || msg.Source != "amqp://broker" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+		if tag == 2 {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+	}
+
+	if len(acker.rejected) != 2 || acker.rejected[0] != 1 || acker.rejected[1] != 4 {
+		t.Errorf("expected undecodable and redelivered messages to be rejected, got %v", acker.rejected)
+	}
+	if len(acker.acks) != 1 || acker.acks[0] != 2 {
+		t.Errorf("expected message 2 to be acknowledged, got %v", acker.acks)
+	}
+	if len(acker.requeued) != 1 || acker.requeued[0] != 3 {
+		t.Errorf("expected message 3 to be requeued, got %v", acker.requeued)
+	}
+
+	cancel()
+	if recv.Next() {
+		t.Errorf("expected Next to return false after cancel")
+	}
+}
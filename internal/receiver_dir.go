@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	_url "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Subdirectories notification files are moved to once processed
+const (
+	DirDone   = "done"
+	DirFailed = "failed"
+)
+
+type DirReceiverOpt func(*DirReceiver)
+
+// WithDirPollInterval sets how often the directory is scanned if it cannot be
+// watched, and how long a file must be unmodified before it is considered to
+// be fully written. The default is 1 second.
+func WithDirPollInterval(interval time.Duration) DirReceiverOpt {
+	return func(r *DirReceiver) {
+		r.interval = interval
+	}
+}
+
+// WithDirPolling scans the directory for new files rather than watching it,
+// e.g., for network filesystems where changes made by other hosts are not
+// reported.
+func WithDirPolling(polling bool) DirReceiverOpt {
+	return func(r *DirReceiver) {
+		r.polling = polling
+	}
+}
+
+// WithDirDecoders sets the decoders used to decode messages. The default is
+// DefaultDecoders.
+func WithDirDecoders(decoders *Decoders) DirReceiverOpt {
+	return func(r *DirReceiver) {
+		r.decoders = decoders
+	}
+}
+
+// IsDirURL returns true if url is a dir:// URL.
+func IsDirURL(url string) bool {
+	return strings.HasPrefix(url, "dir://")
+}
+
+// DirReceiver is a Receiver for notification files written to a directory.
+//
+// Each .json file is a notification, either a raw notification or a Record,
+// and is received once it has not been modified for the poll interval. Files
+// should be written with another extension and renamed if they may take
+// longer than that to write. Once processed, notification files are moved to
+// the done subdirectory, or the failed subdirectory if they could not be
+// decoded or processed.
+type DirReceiver struct {
+	log      *log.Logger
+	ctx      context.Context
+	url      string
+	path     string
+	topic    string
+	topics   []string
+	interval time.Duration
+	polling  bool
+	decoders *Decoders
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	msgs     chan *Message
+	cur      *Message
+	err      error
+}
+
+// NewDirReceiver receives notification files written to the directory at the
+// path of the dir:// URL dirURL. The topic of raw notifications is the topic
+// URL query parameter. Only notifications with topics matching topics are
+// received, others are moved to the done subdirectory.
+//
+// The directory is watched using inotify, or equivalent, falling back to
+// polling if that is not possible.
+func NewDirReceiver(ctx context.Context, dirURL string, topics []string, opts ...DirReceiverOpt) (*DirReceiver, error) {
+	u, err := _url.Parse(dirURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "dir" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	recv := &DirReceiver{
+		log:      log.New(os.Stdout, "[dir] ", log.LstdFlags),
+		ctx:      ctx,
+		url:      dirURL,
+		path:     filepath.FromSlash(u.Host + u.Path),
+		topic:    u.Query().Get("topic"),
+		topics:   topics,
+		interval: time.Second,
+		decoders: DefaultDecoders,
+		inflight: map[string]bool{},
+		msgs:     make(chan *Message),
+	}
+	for _, o := range opts {
+		o(recv)
+	}
+	st, err := os.Stat(recv.path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", recv.path)
+	}
+	for _, name := range []string{DirDone, DirFailed} {
+		if err := os.MkdirAll(filepath.Join(recv.path, name), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	var watcher *fsnotify.Watcher
+	if !recv.polling {
+		watcher, err = fsnotify.NewWatcher()
+		if err == nil {
+			if err = watcher.Add(recv.path); err != nil {
+				watcher.Close()
+				watcher = nil
+			}
+		}
+		if err != nil {
+			recv.log.Printf("cannot watch %s, polling: %s", recv.path, err)
+		}
+	}
+	go recv.watch(watcher)
+
+	return recv, nil
+}
+
+// watch scans the directory for new files when notified of changes by
+// watcher, or every interval if watcher is nil, until ctx is canceled.
+func (r *DirReceiver) watch(watcher *fsnotify.Watcher) {
+	defer close(r.msgs)
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		unsettled, err := r.scan()
+		if err != nil {
+			if r.ctx.Err() == nil {
+				r.err = err
+			}
+			return
+		}
+		// Files that are still being written are checked again after the
+		// interval whether or not there are more changes
+		var tick <-chan time.Time
+		if events == nil || unsettled {
+			tick = ticker.C
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case err := <-errs:
+			r.log.Printf("watching %s failed, polling: %s", r.path, err)
+			events, errs = nil, nil
+		case <-tick:
+		}
+	}
+}
+
+// scan sends a message for each notification file that is fully written,
+// returning true if there are files that may still be being written.
+func (r *DirReceiver) scan() (bool, error) {
+	entries, err := os.ReadDir(r.path)
+	if err != nil {
+		return false, err
+	}
+	unsettled := false
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		fpath := filepath.Join(r.path, e.Name())
+		r.mu.Lock()
+		inflight := r.inflight[fpath]
+		r.mu.Unlock()
+		if inflight {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+		if time.Since(info.ModTime()) < r.interval {
+			unsettled = true
+			continue
+		}
+		if err := r.receive(fpath); err != nil {
+			return false, err
+		}
+	}
+	return unsettled, nil
+}
+
+// receive decodes and sends the notification in fpath, moving it to the done
+// or failed subdirectory once it is acknowledged. Only context errors are
+// returned.
+func (r *DirReceiver) receive(fpath string) error {
+	body, err := os.ReadFile(fpath)
+	if err != nil {
+		r.log.Printf("failed to read %s: %s", fpath, err)
+		return nil
+	}
+	rec := readRecord(r.topic, body)
+	if rec.Topic == "" {
+		r.log.Printf("no topic for %s", fpath)
+		r.move(fpath, DirFailed)
+		return nil
+	}
+	if !matchesAny(r.topics, rec.Topic) {
+		r.move(fpath, DirDone)
+		return nil
+	}
+	msg, err := r.decoders.Decode(rec.Topic, rec.contentType(), rec.body())
+	if err != nil {
+		r.log.Printf("failed to decode message in %s: %s", fpath, err)
+		r.move(fpath, DirFailed)
+		return nil
+	}
+	msg.Source = r.url
+	msg.ack = func(ok bool) error {
+		defer func() {
+			r.mu.Lock()
+			delete(r.inflight, fpath)
+			r.mu.Unlock()
+		}()
+		if ok {
+			return r.move(fpath, DirDone)
+		}
+		return r.move(fpath, DirFailed)
+	}
+
+	r.mu.Lock()
+	r.inflight[fpath] = true
+	r.mu.Unlock()
+	select {
+	case r.msgs <- msg:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// move fpath to the subdirectory dir, logging any error.
+func (r *DirReceiver) move(fpath, dir string) error {
+	err := os.Rename(fpath, filepath.Join(r.path, dir, filepath.Base(fpath)))
+	if err != nil {
+		r.log.Printf("failed to move %s to %s: %s", fpath, dir, err)
+	}
+	return err
+}
+
+// Path returns the directory notification files are received from.
+func (r *DirReceiver) Path() string { return r.path }
+
+func (r *DirReceiver) Message() *Message { return r.cur }
+func (r *DirReceiver) Err() error        { return r.err }
+func (r *DirReceiver) Next() bool {
+	var ok bool
+	select {
+	case r.cur, ok = <-r.msgs:
+	case <-r.ctx.Done():
+	}
+	if !ok {
+		r.cur = nil
+	}
+	return ok
+}
+
+var _ Receiver = (*DirReceiver)(nil)
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirReceiver(t *testing.T) {
+	notif := func(relPath string) string {
+		return `{"baseUrl": "https://host", "relPath": "` + relPath + `"}`
+	}
+	exists := func(t *testing.T, fpath string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(fpath); err == nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Errorf("expected %s to exist", fpath)
+	}
+
+	for _, polling := range []bool{false, true} {
+		t.Run(fmt.Sprintf("polling=%v", polling), func(t *testing.T) {
+			dir := t.TempDir()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			recv, err := NewDirReceiver(ctx, "dir://"+dir+"?topic=a/b", []string{"a/#"},
+				WithDirPollInterval(200*time.Millisecond), WithDirPolling(polling))
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			next := func() *Message {
+				t.Helper()
+				if !recv.Next() {
+					t.Fatalf("expected a message")
+				}
+				return recv.Message()
+			}
+
+			os.WriteFile(filepath.Join(dir, "ignored.txt"), []byte(notif("/0.bufr")), 0o644)
+			os.WriteFile(filepath.Join(dir, "bad.json"), []byte("not json"), 0o644)
+			os.WriteFile(filepath.Join(dir, "1.json"), []byte(notif("/1.bufr")), 0o644)
+			msg := next()
+			if msg.Topic != "a/b" || msg.Payload.RelPath != "/1.bufr" {
+				t.Errorf("unexpected message %+v", msg)
+			}
+			msg.Ack()
+			exists(t, filepath.Join(dir, DirDone, "1.json"))
+			exists(t, filepath.Join(dir, DirFailed, "bad.json"))
+
+			// A file is not received until it is fully written
+			f, _ := os.Create(filepath.Join(dir, "2.json"))
+			f.WriteString(`{"baseUrl": "https://host", `)
+			time.Sleep(20 * time.Millisecond)
+			f.WriteString(`"relPath": "/2.bufr"}`)
+			f.Close()
+			msg = next()
+			if msg.Payload.RelPath != "/2.bufr" {
+				t.Errorf("unexpected message %+v", msg)
+			}
+			msg.Nack()
+			exists(t, filepath.Join(dir, DirFailed, "2.json"))
+
+			if _, err := os.Stat(filepath.Join(dir, "ignored.txt")); err != nil {
+				t.Errorf("expected other files to be ignored, got %s", err)
+			}
+			cancel()
+			if recv.Next() {
+				t.Errorf("expected Next to return false after cancel")
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	_url "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type FileReceiverOpt func(*FileReceiver)
+
+// WithReplaySpeed replays messages with the time between them as received
+// divided by speed, e.g., 1 for the original spacing or 10 for 10 times
+// faster. The default of 0 replays messages as fast as they are consumed.
+func WithReplaySpeed(speed float64) FileReceiverOpt {
+	return func(r *FileReceiver) {
+		r.speed = speed
+	}
+}
+
+// WithFileDecoders sets the decoders used to decode messages. The default is
+// DefaultDecoders.
+func WithFileDecoders(decoders *Decoders) FileReceiverOpt {
+	return func(r *FileReceiver) {
+		r.decoders = decoders
+	}
+}
+
+// IsFileURL returns true if url is a file:// URL.
+func IsFileURL(url string) bool {
+	return strings.HasPrefix(url, "file://")
+}
+
+// FileReceiver is a Receiver that replays notifications from files, e.g., to
+// re-ingest archived notifications or for testing without a broker.
+type FileReceiver struct {
+	log      *log.Logger
+	ctx      context.Context
+	url      string
+	path     string
+	topic    string
+	topics   []string
+	speed    float64
+	decoders *Decoders
+
+	msgs chan *Message
+	cur  *Message
+	err  error
+}
+
+// NewFileReceiver replays the notifications at the path of the file:// URL
+// fileURL. The path is either a file of JSON lines, which may be gzip
+// compressed, or a directory that is searched recursively, in lexical order,
+// for .json files each containing one notification and .jsonl or .jsonl.gz
+// files of JSON lines.
+//
+// Notifications may be Records, such as those written by a Recorder, sidecars,
+// or raw notifications. The topic of a raw notification is
+// the topic URL query parameter if set, otherwise its directory relative to
+// the replayed directory. Raw notifications without a topic are skipped. Only
+// messages with topics matching topics are replayed.
+func NewFileReceiver(ctx context.Context, fileURL string, topics []string, opts ...FileReceiverOpt) (*FileReceiver, error) {
+	u, err := _url.Parse(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	recv := &FileReceiver{
+		log:      log.New(os.Stdout, "[file] ", log.LstdFlags),
+		ctx:      ctx,
+		url:      fileURL,
+		path:     filepath.FromSlash(u.Host + u.Path),
+		topic:    u.Query().Get("topic"),
+		topics:   topics,
+		decoders: DefaultDecoders,
+		msgs:     make(chan *Message),
+	}
+	for _, o := range opts {
+		o(recv)
+	}
+	st, err := os.Stat(recv.path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(recv.msgs)
+		var err error
+		if st.IsDir() {
+			err = recv.replayDir()
+		} else {
+			var last time.Time
+			err = recv.replayFile(recv.path, recv.topic, &last)
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			recv.err = err
+		}
+	}()
+
+	return recv, nil
+}
+
+func (r *FileReceiver) replayDir() error {
+	var last time.Time
+	return filepath.WalkDir(r.path, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		topic := r.topic
+		if topic == "" {
+			rel, _ := filepath.Rel(r.path, filepath.Dir(fpath))
+			if rel != "." {
+				topic = filepath.ToSlash(rel)
+			}
+		}
+		switch {
+		case strings.HasSuffix(fpath, ".jsonl"), strings.HasSuffix(fpath, ".jsonl.gz"):
+			return r.replayFile(fpath, topic, &last)
+		case strings.HasSuffix(fpath, ".json"):
+			body, err := os.ReadFile(fpath)
+			if err != nil {
+				return err
+			}
+			return r.replay(fpath, topic, body, &last)
+		}
+		return nil
+	})
+}
+
+// replayFile replays a file of JSON lines, decompressing it if it has a .gz
+// extension.
+func (r *FileReceiver) replayFile(fpath, topic string, last *time.Time) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if strings.HasSuffix(fpath, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fpath, err)
+		}
+		src = zr
+	}
+	rdr := bufio.NewReader(src)
+	for n := 1; ; n++ {
+		line, err := rdr.ReadBytes('\n')
+		// A file still being written by a Recorder is not terminated
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if err := r.replay(fmt.Sprintf("%s:%d", fpath, n), topic, line, last); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// replay decodes and sends the notification in body after the delay since the
+// last message, updating last. Notifications without a topic or that cannot be
+// decoded are skipped.
+func (r *FileReceiver) replay(where, topic string, body []byte, last *time.Time) error {
+	rec := readRecord(topic, body)
+	if rec.Topic == "" {
+		r.log.Printf("no topic for notification at %s, set the topic URL query parameter", where)
+		return nil
+	}
+	if !matchesAny(r.topics, rec.Topic) {
+		return nil
+	}
+	msg, err := r.decoders.Decode(rec.Topic, rec.contentType(), rec.body())
+	if err != nil {
+		r.log.Printf("failed to decode message at %s: %s", where, err)
+		return nil
+	}
+	msg.Source = r.url
+
+	sent := rec.Received
+	if !sent.IsZero() {
+		msg.Received = sent
+	} else if msg.Payload.PubTime != nil {
+		sent = *msg.Payload.PubTime
+	}
+	if r.speed > 0 && !sent.IsZero() {
+		if !last.IsZero() && sent.After(*last) {
+			select {
+			case <-time.After(time.Duration(float64(sent.Sub(*last)) / r.speed)):
+			case <-r.ctx.Done():
+				return r.ctx.Err()
+			}
+		}
+		*last = sent
+	}
+
+	select {
+	case r.msgs <- msg:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+func (r *FileReceiver) Message() *Message { return r.cur }
+func (r *FileReceiver) Err() error        { return r.err }
+
+// Next returns false once all notifications have been replayed.
+func (r *FileReceiver) Next() bool {
+	var ok bool
+	select {
+	case r.cur, ok = <-r.msgs:
+	case <-r.ctx.Done():
+	}
+	if !ok {
+		r.cur = nil
+	}
+	return ok
+}
+
+var _ Receiver = (*FileReceiver)(nil)
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileReceiver(t *testing.T) {
+	notif := func(relPath string) string {
+		return `{"baseUrl": "https://host", "relPath": "` + relPath + `"}`
+	}
+	receive := func(t *testing.T, url string, opts ...FileReceiverOpt) []*Message {
+		t.Helper()
+		recv, err := NewFileReceiver(context.Background(), url, []string{"a/#"}, opts...)
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		msgs := []*Message{}
+		for recv.Next() {
+			msgs = append(msgs, recv.Message())
+		}
+		if recv.Err() != nil {
+			t.Errorf("expected no error, got %s", recv.Err())
+		}
+		return msgs
+	}
+
+	dir := t.TempDir()
+	lines := filepath.Join(dir, "notifications.jsonl")
+	os.WriteFile(lines, []byte(
+		notif("/1.bufr")+"\n"+
+			"not json\n\n"+
+			`{"topic": "a/c", "received": "2023-01-01T00:00:00Z", "notification": `+notif("/2.bufr")+"}\n"+
+			`{"topic": "x/y", "received": "2023-01-01T00:00:01Z", "notification": `+notif("/3.bufr")+"}\n"+
+			`{"topic": "a/d", "received": "2023-01-01T00:00:01Z", "notification": `+notif("/4.bufr")+"}",
+	), 0o644)
+
+	t.Run("json lines", func(t *testing.T) {
+		start := time.Now()
+		msgs := receive(t, "file://"+lines+"?topic=a/b", WithReplaySpeed(10))
+		if len(msgs) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(msgs))
+		}
+		for i, expected := range []string{"a/b", "a/c", "a/d"} {
+			if msgs[i].Topic != expected {
+				t.Errorf("message %d: expected topic %s, got %s", i, expected, msgs[i].Topic)
+			}
+		}
+		if !msgs[1].Received.Equal(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected original receive time, got %s", msgs[1].Received)
+		}
+		// 1s between the records at 10 times speed
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("expected replay to take at least 100ms, took %s", elapsed)
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		root := filepath.Join(dir, "archive")
+		os.MkdirAll(filepath.Join(root, "a", "b"), 0o755)
+		os.WriteFile(filepath.Join(root, "a", "b", "1.json"), []byte(notif("/1.bufr")), 0o644)
+		os.WriteFile(filepath.Join(root, "a", "b", "2.json"), []byte(notif("/2.bufr")), 0o644)
+		os.WriteFile(filepath.Join(root, "a", "b", "3.txt"), []byte(notif("/3.bufr")), 0o644)
+		os.WriteFile(filepath.Join(root, "top.json"), []byte(notif("/4.bufr")), 0o644)
+
+		msgs := receive(t, "file://"+root)
+		if len(msgs) != 2 {
+			t.Fatalf("expected 2 messages, got %d", len(msgs))
+		}
+		if msgs[0].Topic != "a/b" || msgs[0].Payload.RelPath != "/1.bufr" || msgs[1].Payload.RelPath != "/2.bufr" {
+			t.Errorf("unexpected messages %+v %+v", msgs[0], msgs[1])
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := NewFileReceiver(context.Background(), "file://"+filepath.Join(dir, "missing"), nil); err == nil {
+			t.Errorf("expected error for missing path")
+		}
+	})
+}
@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	_url "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HTTPReceiverOpt func(*HTTPReceiver)
+
+// WithHTTPHMACSecret requires requests to be signed using an HMAC-SHA256 of
+// the body with secret, hex encoded in the X-Hub-Signature-256 header as
+// sha256=<signature>.
+func WithHTTPHMACSecret(secret []byte) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.hmacSecret = secret
+	}
+}
+
+// WithHTTPBearerToken requires requests to have an Authorization header with
+// bearer token.
+func WithHTTPBearerToken(token string) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.bearerToken = token
+	}
+}
+
+// WithHTTPInsecure allows requests without authentication if neither a bearer
+// token nor an HMAC secret is set. Without it, one of them is required.
+func WithHTTPInsecure(insecure bool) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.insecure = insecure
+	}
+}
+
+// WithHTTPSkipTopicValidation accepts topics that are not WIS2 topics. Topics
+// are always checked for levels that are not safe to use in a path.
+func WithHTTPSkipTopicValidation(skip bool) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.skipTopicValidation = skip
+	}
+}
+
+// WithHTTPMaxBodySize sets the maximum size of a request body in bytes. The
+// default is 1MB.
+func WithHTTPMaxBodySize(size int64) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.maxBodySize = size
+	}
+}
+
+// WithHTTPAckTimeout sets how long to wait for the notifications in a request
+// to be processed before responding that they were accepted. The default is 30
+// seconds.
+func WithHTTPAckTimeout(timeout time.Duration) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.ackTimeout = timeout
+	}
+}
+
+// WithHTTPDecoders sets the decoders used to decode received messages. The
+// default is DefaultDecoders.
+func WithHTTPDecoders(decoders *Decoders) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.decoders = decoders
+	}
+}
+
+// WithHTTPRecorder records every notification received, before it is decoded.
+func WithHTTPRecorder(recorder *Recorder) HTTPReceiverOpt {
+	return func(r *HTTPReceiver) {
+		r.recorder = recorder
+	}
+}
+
+// IsHTTPURL returns true if url is an http:// URL.
+func IsHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "http://")
+}
+
+// HTTPReceiver is a Receiver for notifications pushed to it using HTTP POST.
+//
+// The body of a request is a notification, or a JSON array of notifications,
+// that are either raw notifications or Records. The topic of a raw
+// notification is the request path relative to the receiver path, e.g., a
+// notification posted to /notify/origin/a/wis2/x for a receiver with the path
+// /notify has the topic origin/a/wis2/x. Topics must be WIS2 topics, unless
+// WithHTTPSkipTopicValidation is used.
+//
+// The response is not sent until all notifications in the request have been
+// processed so the sender can retry those that fail:
+//
+//	200 all notifications were processed, or ignored since they do not match
+//	    the topics
+//	202 the notifications were accepted but not processed within the ack timeout
+//	400 the body or a notification could not be decoded, or has no topic or
+//	    an invalid topic
+//	401 the signature or bearer token is missing or invalid
+//	413 the body exceeds the maximum size
+//	500 a notification could not be processed
+//	503 the receiver is shutting down
+type HTTPReceiver struct {
+	log         *log.Logger
+	ctx         context.Context
+	url         string
+	path        string
+	topics      []string
+	hmacSecret  []byte
+	bearerToken string
+	insecure    bool
+	maxBodySize int64
+	// skipTopicValidation accepts topics that are not WIS2 topics
+	skipTopicValidation bool
+	ackTimeout          time.Duration
+	decoders            *Decoders
+	recorder            *Recorder
+
+	srv  *http.Server
+	msgs chan *Message
+	done chan struct{}
+	cur  *Message
+	err  error
+}
+
+// NewHTTPReceiver listens on the host and port of the http:// URL receiverURL
+// for notifications posted to its path. Only notifications with topics
+// matching topics are received. The server is shut down when ctx is canceled.
+func NewHTTPReceiver(ctx context.Context, receiverURL string, topics []string, opts ...HTTPReceiverOpt) (*HTTPReceiver, error) {
+	u, err := _url.Parse(receiverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+	recv := &HTTPReceiver{
+		log:         log.New(os.Stdout, "[http] ", log.LstdFlags),
+		ctx:         ctx,
+		url:         receiverURL,
+		path:        "/" + strings.Trim(u.Path, "/"),
+		topics:      topics,
+		maxBodySize: 1024 * 1024,
+		ackTimeout:  30 * time.Second,
+		decoders:    DefaultDecoders,
+		msgs:        make(chan *Message),
+		done:        make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(recv)
+	}
+	if recv.bearerToken == "" && recv.hmacSecret == nil && !recv.insecure {
+		return nil, errors.New("a bearer token or HMAC secret is required")
+	}
+
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	recv.srv = &http.Server{
+		Handler:           recv,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		defer close(recv.done)
+		if err := recv.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			recv.err = err
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		recv.srv.Shutdown(shutdownCtx)
+	}()
+	recv.log.Printf("listening on %s", ln.Addr())
+
+	return recv, nil
+}
+
+// topic returns the topic for a request path, and false if the path is not
+// the receiver path or below it.
+func (r *HTTPReceiver) topic(path string) (string, bool) {
+	if r.path == "/" {
+		return strings.Trim(path, "/"), true
+	}
+	if path != r.path && !strings.HasPrefix(path, r.path+"/") {
+		return "", false
+	}
+	return strings.Trim(strings.TrimPrefix(path, r.path), "/"), true
+}
+
+// checkTopic returns an error if topic is not a WIS2 topic, unless topic
+// validation is skipped, or has levels that are not safe to use in a path since
+// the topic is chosen by the sender.
+func (r *HTTPReceiver) checkTopic(topic string) error {
+	if !r.skipTopicValidation {
+		if _, err := ParseTopic(topic); err != nil {
+			return err
+		}
+	}
+	for _, l := range strings.Split(topic, "/") {
+		if l == "" || l == "." || l == ".." {
+			return fmt.Errorf("invalid topic '%s': level '%s' is not allowed", topic, l)
+		}
+	}
+	return nil
+}
+
+// authorize returns an error if the request is not authorized.
+func (r *HTTPReceiver) authorize(req *http.Request, body []byte) error {
+	if r.bearerToken != "" {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return errors.New("missing bearer token")
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(r.bearerToken)) != 1 {
+			return errors.New("invalid bearer token")
+		}
+	}
+	if r.hmacSecret != nil {
+		sig, err := hex.DecodeString(strings.TrimPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256="))
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+		mac := hmac.New(sha256.New, r.hmacSecret)
+		mac.Write(body)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+// decode returns the messages with topics matching the receiver topics in a
+// request body.
+func (r *HTTPReceiver) decode(topic string, body []byte) ([]*Message, error) {
+	items := []json.RawMessage{body}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, fmt.Errorf("invalid batch: %w", err)
+		}
+	}
+	msgs := []*Message{}
+	for i, item := range items {
+		rec := readRecord(topic, item)
+		if rec.Topic == "" {
+			return nil, fmt.Errorf("notification %d has no topic", i)
+		}
+		if err := r.checkTopic(rec.Topic); err != nil {
+			return nil, fmt.Errorf("notification %d: %w", i, err)
+		}
+		if r.recorder != nil {
+			raw := NewRecord(r.url, rec.Topic, rec.body())
+			raw.Properties = rec.Properties
+			record(r.log, r.recorder, raw)
+		}
+		if !matchesAny(r.topics, rec.Topic) {
+			continue
+		}
+		msg, err := r.decoders.Decode(rec.Topic, rec.contentType(), rec.body())
+		if err != nil {
+			return nil, fmt.Errorf("notification %d: %w", i, err)
+		}
+		msg.Source = r.url
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (r *HTTPReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	topic, ok := r.topic(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, r.maxBodySize+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > r.maxBodySize {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := r.authorize(req, body); err != nil {
+		r.log.Printf("rejected request from %s: %s", req.RemoteAddr, err)
+		if r.bearerToken != "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	msgs, err := r.decode(topic, body)
+	if err != nil {
+		r.log.Printf("rejected request from %s: %s", req.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acks := make(chan bool, len(msgs))
+	for _, msg := range msgs {
+		var once sync.Once
+		msg.ack = func(ok bool) error {
+			once.Do(func() { acks <- ok })
+			return nil
+		}
+		select {
+		case r.msgs <- msg:
+		case <-r.ctx.Done():
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	timeout := time.NewTimer(r.ackTimeout)
+	defer timeout.Stop()
+	for range msgs {
+		select {
+		case ok := <-acks:
+			if !ok {
+				http.Error(w, "processing failed", http.StatusInternalServerError)
+				return
+			}
+		case <-timeout.C:
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *HTTPReceiver) Message() *Message { return r.cur }
+func (r *HTTPReceiver) Err() error        { return r.err }
+func (r *HTTPReceiver) Next() bool {
+	select {
+	case r.cur = <-r.msgs:
+		return true
+	case <-r.ctx.Done():
+	case <-r.done:
+	}
+	r.cur = nil
+	return false
+}
+
+var _ Receiver = (*HTTPReceiver)(nil)
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPReceiver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := []byte("secret")
+	recv, err := NewHTTPReceiver(ctx, "http://127.0.0.1:0/notify", []string{"origin/a/wis2/ca-eccc-msc/#"},
+		WithHTTPBearerToken("token"), WithHTTPHMACSecret(secret), WithHTTPMaxBodySize(512), WithHTTPAckTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	// Messages are acknowledged based on their relPath
+	received := make(chan *Message, 10)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for recv.Next() {
+			msg := recv.Message()
+			received <- msg
+			switch msg.Payload.RelPath {
+			case "/fail":
+				msg.Nack()
+			case "/slow":
+			default:
+				msg.Ack()
+			}
+		}
+	}()
+
+	topic := "origin/a/wis2/ca-eccc-msc/data/core/weather/synop"
+	notif := func(relPath string) string {
+		return `{"baseUrl": "https://host", "relPath": "` + relPath + `"}`
+	}
+	newRequest := func(method, path, body string) *http.Request {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(body))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		return req
+	}
+
+	tests := []struct {
+		Name     string
+		Request  *http.Request
+		Status   int
+		Received int
+	}{
+		{"single", newRequest("POST", "/notify/"+topic, notif("/1.bufr")), 200, 1},
+		{"batch", newRequest("POST", "/notify/"+topic, "["+notif("/1.bufr")+","+notif("/2.bufr")+"]"), 200, 2},
+		{"record", newRequest("POST", "/notify", `{"topic": "`+topic+`", "notification": `+notif("/1.bufr")+"}"), 200, 1},
+		{"other topic", newRequest("POST", "/notify/origin/a/wis2/other/data/core/weather/synop", notif("/1.bufr")), 200, 0},
+		{"failed", newRequest("POST", "/notify/"+topic, "["+notif("/1.bufr")+","+notif("/fail")+"]"), 500, 2},
+		{"not acknowledged", newRequest("POST", "/notify/"+topic, notif("/slow")), 202, 1},
+		{"no topic", newRequest("POST", "/notify", notif("/1.bufr")), 400, 0},
+		{"non-WIS2 topic", newRequest("POST", "/notify/a/b", notif("/1.bufr")), 400, 0},
+		{"parent level", newRequest("POST", "/notify/"+topic+"/../../../../../escaped", notif("/1.bufr")), 400, 0},
+		{"record parent level", newRequest("POST", "/notify", `{"topic": "`+topic+`/../../..", "notification": `+notif("/1.bufr")+"}"), 400, 0},
+		{"empty level", newRequest("POST", "/notify/"+topic+"//x", notif("/1.bufr")), 400, 0},
+		{"undecodable", newRequest("POST", "/notify/"+topic, "not json"), 400, 0},
+		{"too large", newRequest("POST", "/notify/"+topic, notif(strings.Repeat("x", 512))), 413, 0},
+		{"method", newRequest("GET", "/notify/"+topic, ""), 405, 0},
+		{"path", newRequest("POST", "/other/"+topic, notif("/1.bufr")), 404, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			recv.ServeHTTP(w, test.Request)
+			if w.Code != test.Status {
+				t.Errorf("expected status %d, got %d: %s", test.Status, w.Code, w.Body)
+			}
+			if len(received) != test.Received {
+				t.Errorf("expected %d messages, got %d", test.Received, len(received))
+			}
+			for len(received) > 0 {
+				<-received
+			}
+		})
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		req := newRequest("POST", "/notify/"+topic, notif("/1.bufr"))
+		req.Header.Set("Authorization", "Bearer wrong")
+		w := httptest.NewRecorder()
+		recv.ServeHTTP(w, req)
+		if w.Code != 401 || w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("expected 401 for invalid token, got %d", w.Code)
+		}
+
+		req = newRequest("POST", "/notify/"+topic, notif("/1.bufr"))
+		req.Header.Set("Authorization", "token")
+		w = httptest.NewRecorder()
+		recv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("expected 401 for token without Bearer, got %d", w.Code)
+		}
+
+		req = newRequest("POST", "/notify/"+topic, notif("/1.bufr"))
+		req.Header.Set("X-Hub-Signature-256", "sha256=00")
+		w = httptest.NewRecorder()
+		recv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("expected 401 for invalid signature, got %d", w.Code)
+		}
+	})
+
+	cancel()
+	<-consumed
+	req := newRequest("POST", "/notify/"+topic, notif("/1.bufr"))
+	w := httptest.NewRecorder()
+	recv.ServeHTTP(w, req)
+	if w.Code != 503 {
+		t.Errorf("expected 503 after shutdown, got %d", w.Code)
+	}
+}
+
+func TestHTTPReceiverAuthRequired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := NewHTTPReceiver(ctx, "http://127.0.0.1:0/", nil); err == nil {
+		t.Errorf("expected error without a bearer token or HMAC secret")
+	}
+	if _, err := NewHTTPReceiver(ctx, "http://127.0.0.1:0/", nil, WithHTTPInsecure(true)); err != nil {
+		t.Errorf("expected no error with insecure, got %s", err)
+	}
+}
+
+func TestHTTPReceiverSkipTopicValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv, err := NewHTTPReceiver(ctx, "http://127.0.0.1:0/", []string{"#"}, WithHTTPInsecure(true), WithHTTPSkipTopicValidation(true))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	go func() {
+		for recv.Next() {
+			recv.Message().Ack()
+		}
+	}()
+
+	notif := `{"baseUrl": "https://host", "relPath": "/1.bufr"}`
+	tests := []struct {
+		Path   string
+		Status int
+	}{
+		{"/a/b", 200},
+		{"/a/../../b", 400},
+		{"/a//b", 400},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		recv.ServeHTTP(w, httptest.NewRequest("POST", test.Path, strings.NewReader(notif)))
+		if w.Code != test.Status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.Path, test.Status, w.Code, w.Body)
+		}
+	}
+}
@@ -3,17 +3,20 @@ package internal
 import (
 	"context"
 	"crypto/tls"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	_url "net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // ReceiveError is any error that occurs receiving or decoding a message
@@ -35,7 +38,16 @@ func (e *TopicsError) Error() string {
 	return "failed subscriptions for " + strings.Join(e.Failed, ", ")
 }
 
-func connectTCP(uri string, tlsConfig *tls.Config) (net.Conn, error) {
+// websocketConfig configures MQTT over WebSocket connections.
+type websocketConfig struct {
+	headers http.Header
+	// proxy returns the proxy to use, if any, for a request
+	proxy func(*http.Request) (*_url.URL, error)
+}
+
+// dialBroker connects to the broker at uri, which must have a tcp, ssl, ws or
+// wss scheme. TLS is configured by tlsConfig for ssl and wss.
+func dialBroker(uri string, tlsConfig *tls.Config, ws websocketConfig) (net.Conn, error) {
 	u, err := parseURL(uri)
 	if err != nil {
 		return nil, err
@@ -45,6 +57,8 @@ func connectTCP(uri string, tlsConfig *tls.Config) (net.Conn, error) {
 		return net.Dial("tcp", u.Host)
 	case "ssl":
 		return tls.Dial("tcp", u.Host, tlsConfig)
+	case "ws", "wss":
+		return mqtt.NewWebsocket(u.String(), tlsConfig, 0, ws.headers, &mqtt.WebsocketOptions{Proxy: ws.proxy})
 	default:
 		return nil, fmt.Errorf("unsupported scheme '%s'", u.Scheme)
 	}
@@ -61,6 +75,10 @@ func parseURL(url string) (*_url.URL, error) {
 		port = 1883
 	case "ssl":
 		port = 8883
+	case "ws":
+		port = 80
+	case "wss":
+		port = 443
 	default:
 		return nil, fmt.Errorf("invalid")
 	}
@@ -71,41 +89,60 @@ func parseURL(url string) (*_url.URL, error) {
 	return u, nil
 }
 
-func decodeMessage(pub *paho.Publish) (*Message, error) {
-	msg := &Message{
-		Received: time.Now().UTC(),
-		Topic:    pub.Topic,
-	}
-	if err := json.Unmarshal(pub.Payload, &msg.Payload); err != nil {
-		return msg, fmt.Errorf("invalid json: %w", err)
+// publishRecord returns a Record for a publish received from source.
+func publishRecord(source string, pub *paho.Publish) *Record {
+	rec := NewRecord(source, pub.Topic, pub.Payload)
+	rec.QoS = pub.QoS
+	rec.Retain = pub.Retain
+	if p := pub.Properties; p != nil {
+		rec.Properties = &RecordProperties{
+			ContentType:     p.ContentType,
+			PayloadFormat:   p.PayloadFormat,
+			MessageExpiry:   p.MessageExpiry,
+			ResponseTopic:   p.ResponseTopic,
+			CorrelationData: p.CorrelationData,
+		}
+		for _, u := range p.User {
+			rec.Properties.User = append(rec.Properties.User, [2]string{u.Key, u.Value})
+		}
 	}
+	return rec
+}
 
-	// decode b64 encoded integrity value
-	val, err := base64.StdEncoding.DecodeString(msg.Payload.Integrity.Value)
-	if err != nil {
-		return msg, fmt.Errorf("could not decode b64 integrity value")
+func decodeMessage(decoders *Decoders, pub *paho.Publish) (*Message, error) {
+	var contentType string
+	if pub.Properties != nil {
+		contentType = pub.Properties.ContentType
 	}
-	msg.Payload.Integrity.Method = strings.ToLower(msg.Payload.Integrity.Method)
-	msg.Payload.Integrity.Value = string(val)
-
-	return msg, nil
+	return decoders.Decode(pub.Topic, contentType, pub.Payload)
 }
 
 type MQTTReceiverOpt func(*MQTTReceiver)
 
 func WithTLSConfig(cfg *tls.Config) MQTTReceiverOpt {
 	return func(r *MQTTReceiver) {
-		r.tlsConfig = cfg
+		r.tlsConfig = func() *tls.Config { return cfg }
+	}
+}
+
+// WithTLSProvider uses the current configuration from p for each connection so
+// reloaded certificates are used when reconnecting.
+func WithTLSProvider(p *TLSProvider) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.tlsConfig = p.Config
 	}
 }
 
+// WithEnvCredentials uses credentials from the <pfx>_USER and <pfx>_PASSWD
+// environment variables, if set, instead of any in the broker URL. Variables
+// set for later prefixes take precedence if used more than once.
 func WithEnvCredentials(pfx string) MQTTReceiverOpt {
 	return func(r *MQTTReceiver) {
 		if v, ok := os.LookupEnv(pfx + "_USER"); ok {
 			r.user = v
 		}
 		if v, ok := os.LookupEnv(pfx + "_PASSWD"); ok {
-			r.user = v
+			r.passwd = v
 		}
 	}
 }
@@ -123,6 +160,31 @@ func WithQoS(qos byte, cleanStart bool) MQTTReceiverOpt {
 	}
 }
 
+// WithHeaders sets additional HTTP headers sent when connecting to ws:// and
+// wss:// brokers, e.g., for authentication by a proxy.
+func WithHeaders(headers http.Header) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.websocket.headers = headers
+	}
+}
+
+// WithProxy sets the HTTP proxy used to connect to ws:// and wss:// brokers. By
+// default the proxy is determined by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables.
+func WithProxy(proxy *_url.URL) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.websocket.proxy = http.ProxyURL(proxy)
+	}
+}
+
+// WithDecoders sets the decoders used to decode received messages. The default
+// is DefaultDecoders.
+func WithDecoders(decoders *Decoders) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.decoders = decoders
+	}
+}
+
 func WithDebug(debug bool) MQTTReceiverOpt {
 	return func(r *MQTTReceiver) {
 		r.debug = debug
@@ -135,68 +197,368 @@ func WithIgnoreTopicErrors(b bool) MQTTReceiverOpt {
 	}
 }
 
-type MQTTReceiver struct {
+// WithSessionExpiry sets how long the broker keeps the session after the
+// client disconnects so messages are not lost while reconnecting. It is only
+// used with MQTT v5; MQTT 3.1.1 sessions do not expire.
+func WithSessionExpiry(d time.Duration) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.sessionExpiry = uint32(d / time.Second)
+	}
+}
+
+// WithRecorder records every publish received, before it is decoded.
+func WithRecorder(recorder *Recorder) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.recorder = recorder
+	}
+}
+
+// WithShareGroup subscribes to topics as MQTT shared subscriptions in group so
+// that each message is delivered to only one of the receivers in the group.
+func WithShareGroup(group string) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.shareGroup = group
+	}
+}
+
+// WithConnectRetry keeps retrying the initial connection in the background if it
+// fails rather than NewMQTTReceiver returning an error.
+func WithConnectRetry(retry bool) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.connectRetry = retry
+	}
+}
+
+// ConnState is the state of a receiver's connection to its broker.
+type ConnState int32
+
+const (
+	Disconnected ConnState = iota
+	Connecting
+	Connected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	}
+	return fmt.Sprintf("ConnState(%d)", int32(s))
+}
+
+// Backoff parameters used when reconnecting
+var (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 2 * time.Minute
+)
+
+// backoff returns the delay before reconnect attempt n, starting at 0. The delay
+// doubles with each attempt, up to reconnectMaxDelay, with up to 50% jitter.
+func backoff(n int) time.Duration {
+	d := reconnectMinDelay
+	for i := 0; i < n && d < reconnectMaxDelay; i++ {
+		d *= 2
+	}
+	if d > reconnectMaxDelay {
+		d = reconnectMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// connState is the state of a receiver's connection. It is embedded in
+// receivers to implement StatefulReceiver.
+type connState struct {
+	stateMu sync.Mutex
+	state   ConnState
+}
+
+// State returns the current connection state.
+func (s *connState) State() ConnState {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.state
+}
+
+func (s *connState) setState(state ConnState) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.state = state
+}
+
+// maintain calls connect, with exponential backoff until it succeeds, each
+// time the connection to source is lost until ctx is canceled, at which point
+// disconnect is called.
+func maintain(ctx context.Context, logger *log.Logger, source string, state *connState, lost <-chan error, connect func() error, disconnect func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			disconnect()
+			logger.Printf("disconnected from %s", source)
+			return
+		case err := <-lost:
+			state.setState(Disconnected)
+			logger.Printf("connection to %s lost: %s", source, err)
+		}
+
+	reconnect:
+		for attempt := 0; ; attempt++ {
+			delay := backoff(attempt)
+			logger.Printf("reconnecting to %s in %v (attempt %d)", source, delay.Round(time.Millisecond), attempt+1)
+			select {
+			case <-ctx.Done():
+				break reconnect
+			case <-time.After(delay):
+			}
+			if err := connect(); err != nil {
+				logger.Printf("reconnect to %s failed: %s", source, err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// MQTT protocol versions
+const (
+	// MQTTAuto tries MQTT v5, falling back to 3.1.1 if the broker does not support v5
+	MQTTAuto byte = 0
+	MQTTv311 byte = 4
+	MQTTv5   byte = 5
+)
+
+// WithProtocolVersion sets the MQTT protocol version, one of MQTTAuto, MQTTv311
+// or MQTTv5. The default is MQTTAuto.
+func WithProtocolVersion(version byte) MQTTReceiverOpt {
+	return func(r *MQTTReceiver) {
+		r.protocolVersion = version
+	}
+}
+
+const connackUnsupportedProtocolVersion = 0x84
+
+// errProtocolVersion indicates the broker did not accept the protocol version
+var errProtocolVersion = errors.New("protocol version not supported by broker")
+
+// connackConn records the start of the first packet read from the broker, so a
+// 3.1.1 CONNACK, which cannot be decoded as a v5 CONNACK, can be recognised.
+type connackConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	head []byte
+}
+
+func (c *connackConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if want := 2 - len(c.head); want > 0 {
+		if want > n {
+			want = n
+		}
+		c.head = append(c.head, p[:want]...)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// mqtt3Connack returns true if the first packet read was a 3.1.1 CONNACK, which
+// has a remaining length of 2. A v5 CONNACK has properties, so is longer.
+func (c *connackConn) mqtt3Connack() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.head) == 2 && c.head[0] == 0x20 && c.head[1] == 0x02
+}
+
+// ValidateShareGroup returns an error if group is not a valid shared
+// subscription group name.
+func ValidateShareGroup(group string) error {
+	if group == "" || strings.ContainsAny(group, "/+#") {
+		return fmt.Errorf("invalid share group '%s', must not be empty or contain /, + or #", group)
+	}
+	return nil
+}
+
+// mqttConfig is the configuration shared by the MQTT receivers.
+type mqttConfig struct {
 	log   *log.Logger
 	debug bool
+	ctx   context.Context
 
 	url               string
+	topics            []string
 	clientID          string
 	user, passwd      string
 	keepAlive         uint16
 	cleanStart        bool
+	sessionExpiry     uint32 // seconds
 	qos               byte
+	protocolVersion   byte
+	shareGroup        string
 	ignoreTopicErrors bool
-	tlsConfig         *tls.Config
+	connectRetry      bool
+	tlsConfig         func() *tls.Config
+	websocket         websocketConfig
+	decoders          *Decoders
+	recorder          *Recorder
+}
 
+// MQTTReceiver is a Receiver for an MQTT v5 broker. If the connection to the
+// broker is lost, including due to keepalive failures, it is re-established
+// with exponential backoff and all topics are resubscribed.
+type MQTTReceiver struct {
+	mqttConfig
+
+	connState
+
+	mu          sync.Mutex
 	client      *paho.Client
-	publishings chan *paho.Publish
+	conn        *connackConn
+	lost        chan error
+	publishings chan publishing
 	cur         *Message
 	err         error
 }
 
-func NewMQTTReceiver(ctx context.Context, brokerURL string, topics []string, opts ...MQTTReceiverOpt) (Receiver, error) {
+// NewMQTTReceiver connects to the broker and subscribes to topics. An error is
+// returned if the initial connection fails, unless WithConnectRetry is used,
+// after which the connection is maintained until ctx is canceled, at which
+// point the client is disconnected and Next will return false.
+//
+// The returned Receiver is an MQTT3Receiver if MQTT 3.1.1 is used.
+func NewMQTTReceiver(ctx context.Context, brokerURL string, topics []string, opts ...MQTTReceiverOpt) (StatefulReceiver, error) {
 	recv := &MQTTReceiver{
-		url:         brokerURL,
-		log:         log.New(os.Stdout, "[broker] ", log.LstdFlags),
-		keepAlive:   30,
-		cleanStart:  false,
-		qos:         1,
-		publishings: make(chan *paho.Publish),
+		mqttConfig: mqttConfig{
+			url:        brokerURL,
+			topics:     topics,
+			log:        log.New(os.Stdout, "[broker] ", log.LstdFlags),
+			keepAlive:  30,
+			cleanStart: false,
+			qos:        1,
+			ctx:        ctx,
+			decoders:   DefaultDecoders,
+			// nil uses the default TLS configuration
+			tlsConfig: func() *tls.Config { return nil },
+		},
+		lost:        make(chan error, 1),
+		publishings: make(chan publishing),
 	}
 
+	// Credentials in the URL are the default, e.g., for WithEnvCredentials to
+	// override, and are removed so the clients and logs do not use them
+	if u, err := _url.Parse(brokerURL); err == nil && u.User != nil {
+		recv.user = u.User.Username()
+		recv.passwd, _ = u.User.Password()
+		u.User = nil
+		recv.url = u.String()
+	}
 	for _, o := range opts {
 		o(recv)
 	}
 
-	if err := recv.createClient(); err != nil {
-		return nil, fmt.Errorf("creating client: %w", err)
+	if recv.protocolVersion == MQTTv311 {
+		return newMQTT3Receiver(recv.mqttConfig)
 	}
-	if err := recv.connect(ctx); err != nil {
-		return nil, fmt.Errorf("connecting: %w", err)
-	}
-	if err := recv.subscribe(topics); err != nil {
-		return nil, fmt.Errorf("subscribing: %w", err)
+
+	if err := recv.connectAndSubscribe(); err != nil {
+		if recv.protocolVersion == MQTTAuto && errors.Is(err, errProtocolVersion) {
+			recv.log.Printf("%s does not support MQTT v5, using 3.1.1: %s", recv.url, err)
+			return newMQTT3Receiver(recv.mqttConfig)
+		}
+		if !recv.connectRetry {
+			return nil, err
+		}
+		recv.lost <- err
 	}
+	go maintain(ctx, recv.log, recv.url, &recv.connState, recv.lost, recv.connectAndSubscribe, recv.disconnect)
 
 	return recv, nil
 }
 
+func (r *MQTTReceiver) connectAndSubscribe() error {
+	r.setState(Connecting)
+	if err := r.createClient(); err != nil {
+		r.setState(Disconnected)
+		return fmt.Errorf("creating client: %w", err)
+	}
+	if err := r.connect(r.ctx); err != nil {
+		r.setState(Disconnected)
+		return fmt.Errorf("connecting: %w", err)
+	}
+	if err := r.subscribe(r.topics); err != nil {
+		r.disconnect()
+		return fmt.Errorf("subscribing: %w", err)
+	}
+	r.setState(Connected)
+	r.log.Printf("connected to %s", r.url)
+	return nil
+}
+
+func (r *MQTTReceiver) disconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client != nil {
+		r.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+	r.setState(Disconnected)
+}
+
+// connectionLost notifies maintain that the connection for client c was lost.
+// Notifications for clients other than the current client are ignored.
+func (r *MQTTReceiver) connectionLost(c *paho.Client, err error) {
+	r.mu.Lock()
+	current := c == r.client
+	r.mu.Unlock()
+	if !current {
+		return
+	}
+	select {
+	case r.lost <- err:
+	default:
+	}
+}
+
 func (r *MQTTReceiver) createClient() error {
-	conn, err := connectTCP(r.url, r.tlsConfig)
+	nc, err := dialBroker(r.url, r.tlsConfig(), r.websocket)
 	if err != nil {
 		return err
 	}
-	c := paho.NewClient(paho.ClientConfig{
+	conn := &connackConn{Conn: nc}
+	var c *paho.Client
+	c = paho.NewClient(paho.ClientConfig{
 		ClientID: r.clientID,
 		Conn:     conn,
 		Router: paho.NewSingleHandlerRouter(func(m *paho.Publish) {
-			r.publishings <- m
+			select {
+			case r.publishings <- publishing{client: c, pub: m}:
+			case <-r.ctx.Done():
+			}
 		}),
+		// Messages are acknowledged once processed so they are redelivered if
+		// the process stops before then
+		EnableManualAcknowledgment: true,
+		OnClientError: func(err error) {
+			r.connectionLost(c, err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			reason := ""
+			if d.Properties != nil {
+				reason = d.Properties.ReasonString
+			}
+			r.connectionLost(c, fmt.Errorf("server disconnect [%v] %s", d.ReasonCode, reason))
+		},
 	})
 	c.SetErrorLogger(r.log)
 	if r.debug {
-		r.client.SetDebugLogger(r.log)
+		c.SetDebugLogger(r.log)
 	}
+	r.mu.Lock()
+	r.client = c
+	r.conn = conn
+	r.mu.Unlock()
 	return nil
 }
 
@@ -210,65 +572,123 @@ func (r *MQTTReceiver) connect(ctx context.Context) error {
 	}
 	req.UsernameFlag = r.user != ""
 	req.PasswordFlag = r.passwd != ""
+	if r.sessionExpiry > 0 {
+		req.Properties = &paho.ConnectProperties{SessionExpiryInterval: &r.sessionExpiry}
+	}
 	resp, err := r.client.Connect(ctx, req)
 	// Docs are indicate there may be a connack if there is an error
 	if resp != nil && err != nil {
+		if resp.ReasonCode == connackUnsupportedProtocolVersion {
+			err = fmt.Errorf("%w: %s", errProtocolVersion, err)
+		}
 		return fmt.Errorf("[%v] %s: %w", resp.ReasonCode, resp.Properties.ReasonString, err)
 	} else if err != nil {
+		// A broker that does not support v5 responds with a 3.1.1 CONNACK, which
+		// cannot be decoded. Other errors, e.g., timeouts, are not a reason to
+		// fall back to 3.1.1.
+		if r.conn.mqtt3Connack() {
+			err = fmt.Errorf("%w: %s", errProtocolVersion, err)
+		}
 		return err
 	}
 	if resp.ReasonCode != 0 {
 		return fmt.Errorf("[%v] %s", resp.ReasonCode, resp.Properties.ReasonString)
 	}
-
-	go func() {
-		<-ctx.Done()
-		r.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
-	}()
-
+	// Use the id assigned by the broker when reconnecting so the session is resumed
+	if resp.Properties.AssignedClientID != "" {
+		r.clientID = resp.Properties.AssignedClientID
+		r.log.Printf("broker assigned client id %s", r.clientID)
+	}
+	logSession(r.log, r.url, r.clientID, resp.SessionPresent)
 	return nil
 }
 
-func (r *MQTTReceiver) subscribe(topics []string) error {
-	// MQTT Subscribe
-	scrips := map[string]paho.SubscribeOptions{}
-	for _, topic := range topics {
-		scrips[topic] = paho.SubscribeOptions{QoS: byte(r.qos)}
+func logSession(log *log.Logger, url, clientID string, resumed bool) {
+	if resumed {
+		log.Printf("resumed session for client id %s on %s", clientID, url)
+	} else {
+		log.Printf("started new session for client id %s on %s", clientID, url)
 	}
-	sa, err := r.client.Subscribe(context.Background(), &paho.Subscribe{
-		Subscriptions: scrips,
-	})
-	if err != nil {
-		return err
+}
+
+// filter returns the subscription topic filter for topic.
+func (c *mqttConfig) filter(topic string) string {
+	if c.shareGroup == "" {
+		return topic
 	}
+	return "$share/" + c.shareGroup + "/" + topic
+}
+
+func (r *MQTTReceiver) subscribe(topics []string) error {
+	// Subscribe to each topic individually so failures can be attributed to a topic
 	failed := []string{}
-	for idx, reason := range sa.Reasons {
-		if reason != byte(r.qos) && !r.ignoreTopicErrors {
-			failed = append(failed, topics[idx])
+	for _, topic := range topics {
+		sa, err := r.client.Subscribe(r.ctx, &paho.Subscribe{
+			Subscriptions: map[string]paho.SubscribeOptions{
+				r.filter(topic): {QoS: r.qos},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("creating subscriptions: %w", err)
+		}
+		// Reason codes below 0x80 are the granted QoS
+		for _, reason := range sa.Reasons {
+			if reason >= 0x80 {
+				r.log.Printf("subscription to %s failed [%v]", topic, reason)
+				failed = append(failed, topic)
+			}
 		}
 	}
-	if err != nil {
-		return fmt.Errorf("creating subscriptions: %w", err)
-	}
-	if len(failed) > 0 {
+	if len(failed) > 0 && !r.ignoreTopicErrors {
 		return &TopicsError{Failed: failed}
 	}
 	return nil
 }
 
+// publishing is a received publish and the client that received it.
+type publishing struct {
+	client *paho.Client
+	pub    *paho.Publish
+}
+
+// ack acknowledges the publish. Publishes cannot be rejected, so they are
+// acknowledged whether or not they were processed.
+func (p publishing) ack(bool) error {
+	err := p.client.Ack(p.pub)
+	if errors.Is(err, paho.ErrPacketNotFound) {
+		// The connection was lost since it was received, so it will be
+		// redelivered if the session is resumed
+		return nil
+	}
+	return err
+}
+
 func (r *MQTTReceiver) Message() *Message { return r.cur }
 func (r *MQTTReceiver) Err() error        { return r.err }
 func (r *MQTTReceiver) Next() bool {
-	if r.err != nil {
-		return false
-	}
-	pub, ok := <-r.publishings
-	if !ok {
-		r.cur = nil
-		return false
+	for {
+		var p publishing
+		select {
+		case p = <-r.publishings:
+		case <-r.ctx.Done():
+			r.cur = nil
+			return false
+		}
+		if r.recorder != nil {
+			record(r.log, r.recorder, publishRecord(r.url, p.pub))
+		}
+		msg, err := decodeMessage(r.decoders, p.pub)
+		if err != nil {
+			// A bad message should not stop message consumption
+			r.log.Printf("failed to decode message on topic '%s': %s", p.pub.Topic, err)
+			p.ack(false)
+			continue
+		}
+		msg.Source = r.url
+		msg.ack = p.ack
+		r.cur = msg
+		return true
 	}
-	r.cur, r.err = decodeMessage(pub)
-	return r.err == nil
 }
 
 var _ Receiver = (*MQTTReceiver)(nil)
@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	_url "net/url"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT3Receiver is a Receiver for an MQTT 3.1.1 broker, created by
+// NewMQTTReceiver. Like MQTTReceiver, lost connections are re-established with
+// exponential backoff and all topics are resubscribed.
+type MQTT3Receiver struct {
+	mqttConfig
+
+	connState
+
+	client      mqtt.Client
+	subscribed  chan error
+	publishings *publishQueue
+	cur         *Message
+	err         error
+}
+
+// mqtt3QueueSize is the number of publishes received but not yet acknowledged
+// after which receiving waits for messages to be processed.
+const mqtt3QueueSize = 1000
+
+// publishQueue holds received publishes until they are acknowledged, so
+// acknowledgements are sent in the order publishes were received, as MQTT
+// requires, although messages may be processed concurrently.
+type publishQueue struct {
+	// slots has an entry for each queued publish, limiting the queue size
+	slots chan struct{}
+	ready chan struct{}
+
+	mu      sync.Mutex
+	pending []*queuedPublish
+	// next is the index in pending of the next publish for Next
+	next int
+	// conn is incremented when the connection is lost, as publishes cannot be
+	// acknowledged on another connection
+	conn int
+}
+
+type queuedPublish struct {
+	mqtt.Message
+	conn  int
+	acked bool
+}
+
+func newPublishQueue(size int) *publishQueue {
+	return &publishQueue{slots: make(chan struct{}, size), ready: make(chan struct{}, 1)}
+}
+
+// push adds pub to the queue. If the queue is full it waits until there is
+// space, or drops pub for the broker to redeliver if ctx is done or open
+// returns false because the connection is closed.
+func (q *publishQueue) push(ctx context.Context, open func() bool, pub mqtt.Message) {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+	wait:
+		for {
+			select {
+			case q.slots <- struct{}{}:
+				break wait
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !open() {
+					return
+				}
+			}
+		}
+	}
+	q.mu.Lock()
+	q.pending = append(q.pending, &queuedPublish{Message: pub, conn: q.conn})
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next publish for Next, or nil if there are none.
+func (q *publishQueue) pop() *queuedPublish {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.next == len(q.pending) {
+		return nil
+	}
+	q.next++
+	return q.pending[q.next-1]
+}
+
+// ack marks pub acknowledged, acknowledging it once all publishes received
+// before it are. Publishes received on a lost connection are not acknowledged.
+func (q *publishQueue) ack(pub *queuedPublish) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pub.conn != q.conn {
+		return
+	}
+	pub.acked = true
+	for len(q.pending) > 0 && q.pending[0].acked {
+		q.pending[0].Ack()
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.next--
+		<-q.slots
+	}
+}
+
+// reset drops all publishes before reconnecting. The broker redelivers
+// those that were not acknowledged when the session is resumed.
+func (q *publishQueue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for range q.pending {
+		<-q.slots
+	}
+	q.pending = nil
+	q.next = 0
+	q.conn++
+}
+
+func newMQTT3Receiver(cfg mqttConfig) (*MQTT3Receiver, error) {
+	recv := &MQTT3Receiver{
+		mqttConfig:  cfg,
+		connState:   connState{state: Connecting},
+		subscribed:  make(chan error, 1),
+		publishings: newPublishQueue(mqtt3QueueSize),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.url).
+		SetClientID(cfg.clientID).
+		SetUsername(cfg.user).
+		SetPassword(cfg.passwd).
+		SetCleanSession(cfg.cleanStart).
+		SetKeepAlive(time.Duration(cfg.keepAlive) * time.Second).
+		SetProtocolVersion(uint(MQTTv311)).
+		// Publishes are handled in the order received so they can be
+		// acknowledged in that order
+		SetOrderMatters(true).
+		// Messages are acknowledged once processed so they are redelivered if
+		// the process stops before then
+		SetAutoAckDisabled(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(cfg.connectRetry).
+		SetConnectRetryInterval(reconnectMinDelay).
+		SetMaxReconnectInterval(reconnectMaxDelay).
+		SetCustomOpenConnectionFn(func(*_url.URL, mqtt.ClientOptions) (net.Conn, error) {
+			return dialBroker(cfg.url, cfg.tlsConfig(), cfg.websocket)
+		}).
+		// Messages for a resumed session may arrive before topics are resubscribed
+		SetDefaultPublishHandler(recv.handle).
+		SetOnConnectHandler(recv.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			recv.setState(Disconnected)
+			recv.log.Printf("connection to %s lost: %s", recv.url, err)
+		}).
+		// Called before each reconnect attempt, so before any publishes are
+		// received on the new connection
+		SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+			recv.publishings.reset()
+			recv.setState(Connecting)
+			recv.log.Printf("reconnecting to %s", recv.url)
+		})
+	if cfg.debug {
+		mqtt.ERROR = recv.log
+		mqtt.DEBUG = recv.log
+	}
+	recv.client = mqtt.NewClient(opts)
+
+	// With connect retry the connect token does not complete until connected, so
+	// connecting continues in the background
+	token := recv.client.Connect()
+	if !cfg.connectRetry {
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return nil, fmt.Errorf("connecting: %w", err)
+		}
+		logSession(recv.log, recv.url, recv.clientID, token.(*mqtt.ConnectToken).SessionPresent())
+		if err := <-recv.subscribed; err != nil {
+			recv.client.Disconnect(250)
+			return nil, fmt.Errorf("subscribing: %w", err)
+		}
+	}
+
+	go func() {
+		<-recv.ctx.Done()
+		recv.client.Disconnect(250)
+		recv.setState(Disconnected)
+		recv.log.Printf("disconnected from %s", recv.url)
+	}()
+
+	return recv, nil
+}
+
+// onConnect subscribes to all topics on each connect, whether or not the
+// broker has retained the session.
+func (r *MQTT3Receiver) onConnect(c mqtt.Client) {
+	err := r.subscribe()
+	select {
+	case r.subscribed <- err:
+	default:
+	}
+	if err != nil {
+		r.log.Printf("subscribing on %s failed: %s", r.url, err)
+		return
+	}
+	r.setState(Connected)
+	r.log.Printf("connected to %s", r.url)
+}
+
+// handle queues m for Next, waiting if too many messages have not been
+// processed. The connection cannot be closed while a handler is running, so
+// handle returns if it is lost.
+func (r *MQTT3Receiver) handle(c mqtt.Client, m mqtt.Message) {
+	r.publishings.push(r.ctx, c.IsConnectionOpen, m)
+}
+
+func (r *MQTT3Receiver) subscribe() error {
+	failed := []string{}
+	for _, topic := range r.topics {
+		filter := r.filter(topic)
+		token := r.client.Subscribe(filter, r.qos, r.handle)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("creating subscriptions: %w", err)
+		}
+		// Return codes below 0x80 are the granted QoS
+		if reason := token.(*mqtt.SubscribeToken).Result()[filter]; reason >= 0x80 {
+			r.log.Printf("subscription to %s failed [%v]", topic, reason)
+			failed = append(failed, topic)
+		}
+	}
+	if len(failed) > 0 && !r.ignoreTopicErrors {
+		return &TopicsError{Failed: failed}
+	}
+	return nil
+}
+
+func (r *MQTT3Receiver) Message() *Message { return r.cur }
+func (r *MQTT3Receiver) Err() error        { return r.err }
+func (r *MQTT3Receiver) Next() bool {
+	for {
+		pub := r.publishings.pop()
+		if pub == nil {
+			select {
+			case <-r.publishings.ready:
+				continue
+			case <-r.ctx.Done():
+				r.cur = nil
+				return false
+			}
+		}
+		if r.recorder != nil {
+			rec := NewRecord(r.url, pub.Topic(), pub.Payload())
+			rec.QoS = pub.Qos()
+			rec.Retain = pub.Retained()
+			record(r.log, r.recorder, rec)
+		}
+		// MQTT 3.1.1 has no content type, so decoders are selected by topic or content
+		msg, err := r.decoders.Decode(pub.Topic(), "", pub.Payload())
+		if err != nil {
+			// A bad message should not stop message consumption
+			r.log.Printf("failed to decode message on topic '%s': %s", pub.Topic(), err)
+			r.publishings.ack(pub)
+			continue
+		}
+		msg.Source = r.url
+		// Publishes cannot be rejected, so they are acknowledged whether or not
+		// they were processed
+		msg.ack = func(bool) error {
+			r.publishings.ack(pub)
+			return nil
+		}
+		r.cur = msg
+		return true
+	}
+}
+
+var _ StatefulReceiver = (*MQTT3Receiver)(nil)
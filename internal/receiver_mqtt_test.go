@@ -1,6 +1,277 @@
 package internal
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt3 "github.com/eclipse/paho.mqtt.golang"
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+)
+
+// fakeBroker is a minimal MQTT broker that accepts connections and grants all
+// subscriptions, for testing the receiver against. It speaks MQTT v5 unless v3
+// is set, in which case it only accepts MQTT 3.1.1.
+type fakeBroker struct {
+	t         *testing.T
+	ln        net.Listener
+	brokerURL string
+	v3        bool
+	// header is the request header of the last WebSocket connection
+	header http.Header
+
+	mu            sync.Mutex
+	conn          net.Conn
+	connects      []*packets.Connect
+	subscriptions []string
+	// acks are the packet ids of acknowledged publishes
+	acks []uint16
+	// subscribed receives a value after each SUBACK is sent
+	subscribed chan struct{}
+}
+
+func newFakeBroker(t *testing.T, v3 bool) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, brokerURL: "tcp://" + ln.Addr().String(), v3: v3, subscribed: make(chan struct{}, 10)}
+	t.Cleanup(func() {
+		ln.Close()
+		b.drop()
+	})
+	go b.serve()
+	return b
+}
+
+// newFakeWSBroker returns an MQTT v5 fakeBroker accepting MQTT over WebSocket
+// connections, using TLS if secure is true.
+func newFakeWSBroker(t *testing.T, secure bool) *fakeBroker {
+	b := &fakeBroker{t: t, subscribed: make(chan struct{}, 10)}
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrading: %s", err)
+			return
+		}
+		b.mu.Lock()
+		b.header = r.Header
+		b.mu.Unlock()
+		b.accept(&wsConn{Conn: ws})
+	})
+	var srv *httptest.Server
+	if secure {
+		srv = httptest.NewTLSServer(handler)
+	} else {
+		srv = httptest.NewServer(handler)
+	}
+	t.Cleanup(func() {
+		b.drop()
+		srv.Close()
+	})
+	b.brokerURL = strings.Replace(srv.URL, "http", "ws", 1) + "/mqtt"
+	return b
+}
+
+// wsConn is a net.Conn for a WebSocket connection.
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (b *fakeBroker) url() string { return b.brokerURL }
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.accept(conn)
+	}
+}
+
+func (b *fakeBroker) accept(conn net.Conn) {
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	if b.v3 {
+		b.handle3(conn)
+	} else {
+		b.handle(conn)
+	}
+}
+
+func (b *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			b.connects = append(b.connects, p)
+			ca := &packets.Connack{Properties: &packets.Properties{}}
+			if p.ClientID == "" {
+				ca.Properties.AssignedClientID = "assigned"
+			}
+			ca.WriteTo(conn)
+		case *packets.Subscribe:
+			reasons := []byte{}
+			for topic, opts := range p.Subscriptions {
+				b.subscriptions = append(b.subscriptions, topic)
+				reasons = append(reasons, opts.QoS)
+			}
+			(&packets.Suback{PacketID: p.PacketID, Reasons: reasons}).WriteTo(conn)
+			b.subscribed <- struct{}{}
+		case *packets.Puback:
+			b.acks = append(b.acks, p.PacketID)
+		case *packets.Pingreq:
+			(&packets.Pingresp{}).WriteTo(conn)
+		case *packets.Disconnect:
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *fakeBroker) handle3(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// The protocol level follows the fixed header and the protocol name, assuming
+	// the remaining length fits in 1 byte
+	if hdr, err := r.Peek(9); err != nil || hdr[8] != 4 {
+		ca := packets3.NewControlPacket(packets3.Connack).(*packets3.ConnackPacket)
+		ca.ReturnCode = packets3.ErrRefusedBadProtocolVersion
+		ca.Write(conn)
+		return
+	}
+	for {
+		cp, err := packets3.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		switch p := cp.(type) {
+		case *packets3.ConnectPacket:
+			b.connects = append(b.connects, &packets.Connect{
+				ClientID:        p.ClientIdentifier,
+				ProtocolVersion: p.ProtocolVersion,
+				Username:        p.Username,
+				Password:        p.Password,
+			})
+			packets3.NewControlPacket(packets3.Connack).Write(conn)
+		case *packets3.SubscribePacket:
+			sa := packets3.NewControlPacket(packets3.Suback).(*packets3.SubackPacket)
+			sa.MessageID = p.MessageID
+			sa.ReturnCodes = p.Qoss
+			b.subscriptions = append(b.subscriptions, p.Topics...)
+			sa.Write(conn)
+			b.subscribed <- struct{}{}
+		case *packets3.PubackPacket:
+			b.acks = append(b.acks, p.MessageID)
+		case *packets3.PingreqPacket:
+			packets3.NewControlPacket(packets3.Pingresp).Write(conn)
+		case *packets3.DisconnectPacket:
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+	}
+}
+
+// publish a QoS 0 message to the current connection.
+func (b *fakeBroker) publish(topic string, payload []byte) {
+	b.publishQoS(topic, payload, 0, 0)
+}
+
+// publishQoS publishes a message with packet id for QoS > 0.
+func (b *fakeBroker) publishQoS(topic string, payload []byte, qos byte, id uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	if b.v3 {
+		pub := packets3.NewControlPacket(packets3.Publish).(*packets3.PublishPacket)
+		pub.TopicName = topic
+		pub.Payload = payload
+		pub.Qos = qos
+		pub.MessageID = id
+		err = pub.Write(b.conn)
+	} else {
+		_, err = (&packets.Publish{Topic: topic, Payload: payload, QoS: qos, PacketID: id}).WriteTo(b.conn)
+	}
+	if err != nil {
+		b.t.Errorf("publishing: %s", err)
+	}
+}
+
+// drop the current connection without a DISCONNECT, as if the network failed.
+func (b *fakeBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+func (b *fakeBroker) waitSubscribed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-b.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for subscription")
+	}
+}
 
 func TestParseURL(t *testing.T) {
 	tests := []struct {
@@ -12,6 +283,9 @@ func TestParseURL(t *testing.T) {
 		{"tcp://host:999", "tcp://host:999", false},
 		{"ssl://host", "ssl://host:8883", false},
 		{"ssl://host:999", "ssl://host:999", false},
+		{"ws://host/mqtt", "ws://host:80/mqtt", false},
+		{"wss://host/mqtt", "wss://host:443/mqtt", false},
+		{"wss://host:8443", "wss://host:8443", false},
 		{"http://host", "", true},
 	}
 	for _, test := range tests {
@@ -30,3 +304,500 @@ func TestParseURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeMessage(t *testing.T) {
+	t.Run("legacy", func(t *testing.T) {
+		body := []byte(`{
+			"pubTime": "2022-01-01T00:00:00Z",
+			"baseUrl": "https://host",
+			"relPath": "/path/file.bufr",
+			"integrity": {"method": "MD5", "value": "ZDQxZDhjZDk4ZjAwYjIwNGU5ODAwOTk4ZWNmODQyN2U="},
+			"size": 10
+		}`)
+		msg, err := decodeMessage(DefaultDecoders, &paho.Publish{Topic: "a/b", Payload: body})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if msg.Topic != "a/b" {
+			t.Errorf("expected topic a/b, got %s", msg.Topic)
+		}
+		if msg.Payload.URL() != "https:/host/path/file.bufr" {
+			t.Errorf("unexpected url %s", msg.Payload.URL())
+		}
+		if msg.Payload.Integrity.Method != "md5" || msg.Payload.Integrity.Value != "d41d8cd98f00b204e9800998ecf8427e" {
+			t.Errorf("unexpected integrity %+v", msg.Payload.Integrity)
+		}
+		if msg.Payload.Size != 10 {
+			t.Errorf("expected size 10, got %v", msg.Payload.Size)
+		}
+	})
+
+	t.Run("wnm", func(t *testing.T) {
+		body := []byte(`{
+			"id": "31e9d66a-cd83-4174-9429-b932f1abe1be",
+			"conformsTo": ["http://wis.wmo.int/spec/wnm/1/conf/core"],
+			"type": "Feature",
+			"geometry": {"type": "Point", "coordinates": [6.146, 46.223]},
+			"properties": {
+				"data_id": "wis2/ca-eccc-msc/data/core/weather/surface-based-observations/synop/file.bufr4",
+				"metadata_id": "urn:wmo:md:ca-eccc-msc:synop",
+				"pubtime": "2022-03-20T04:50:18Z",
+				"integrity": {"method": "md5", "value": "1B2M2Y8AsgTpgAmY7PhCfg=="}
+			},
+			"links": [
+				{"href": "https://host/via", "rel": "via"},
+				{"href": "https://host/path/file.bufr4?x=y", "rel": "canonical", "type": "application/bufr", "length": 123}
+			]
+		}`)
+		msg, err := decodeMessage(DefaultDecoders, &paho.Publish{Topic: "a/b", Payload: body})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		wis := msg.Payload
+		if wis.ID != "31e9d66a-cd83-4174-9429-b932f1abe1be" {
+			t.Errorf("unexpected id %s", wis.ID)
+		}
+		if wis.URL() != "https://host/path/file.bufr4?x=y" {
+			t.Errorf("expected canonical link url, got %s", wis.URL())
+		}
+		if wis.Name() != "file.bufr4" {
+			t.Errorf("expected name file.bufr4, got %s", wis.Name())
+		}
+		if wis.Size != 123 {
+			t.Errorf("expected size 123, got %v", wis.Size)
+		}
+		if wis.PubTime == nil || wis.PubTime.Unix() != 1647751818 {
+			t.Errorf("unexpected pubtime %v", wis.PubTime)
+		}
+		if wis.Integrity.Method != "md5" || wis.Integrity.Value != "d41d8cd98f00b204e9800998ecf8427e" {
+			t.Errorf("unexpected integrity %+v", wis.Integrity)
+		}
+		if len(wis.Geometry) == 0 {
+			t.Errorf("expected geometry")
+		}
+		if err := wis.IsValid(); err != nil {
+			t.Errorf("expected valid message, got %s", err)
+		}
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		_, err := decodeMessage(DefaultDecoders, &paho.Publish{Topic: "a/b", Payload: []byte("{")})
+		if err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	for n := 0; n < 20; n++ {
+		d := backoff(n)
+		ceil := reconnectMinDelay << n
+		if n > 10 || ceil > reconnectMaxDelay {
+			ceil = reconnectMaxDelay
+		}
+		if d < ceil/2 || d > ceil {
+			t.Errorf("attempt %d: expected delay in [%v, %v], got %v", n, ceil/2, ceil, d)
+		}
+	}
+}
+
+func TestMQTTReceiverReconnect(t *testing.T) {
+	defer func(d time.Duration) { reconnectMinDelay = d }(reconnectMinDelay)
+	reconnectMinDelay = 10 * time.Millisecond
+
+	for _, v3 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v3=%v", v3), func(t *testing.T) {
+			testMQTTReceiverReconnect(t, v3)
+		})
+	}
+}
+
+func testMQTTReceiverReconnect(t *testing.T, v3 bool) {
+	broker := newFakeBroker(t, v3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recv, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b", "c/#"})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	broker.waitSubscribed(t)
+	broker.waitSubscribed(t)
+	if recv.State() != Connected {
+		t.Fatalf("expected connected, got %s", recv.State())
+	}
+	if _, ok := recv.(*MQTT3Receiver); ok != v3 {
+		t.Fatalf("expected 3.1.1 receiver=%v, got %T", v3, recv)
+	}
+
+	body := []byte(`{"baseUrl": "https://host", "relPath": "/file.bufr", "integrity": {"method": "md5", "value": "d41d8cd98f00b204e9800998ecf8427e"}}`)
+	broker.drop()
+	broker.waitSubscribed(t)
+	broker.waitSubscribed(t)
+
+	broker.publish("a/b", body)
+	if !recv.Next() {
+		t.Fatalf("expected a message after reconnect")
+	}
+	if recv.Message().Source != broker.url() {
+		t.Errorf("expected source %s, got %s", broker.url(), recv.Message().Source)
+	}
+
+	broker.mu.Lock()
+	if len(broker.connects) != 2 {
+		t.Errorf("expected 2 successful connects, got %d", len(broker.connects))
+	}
+	if len(broker.subscriptions) != 4 {
+		t.Errorf("expected topics to be resubscribed, got %v", broker.subscriptions)
+	}
+	broker.mu.Unlock()
+
+	cancel()
+	if recv.Next() {
+		t.Errorf("expected Next to return false after cancel")
+	}
+}
+
+func TestMQTTReceiverFallback(t *testing.T) {
+	t.Run("3.1.1 broker", func(t *testing.T) {
+		broker := newFakeBroker(t, true)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		recv, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b"})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if _, ok := recv.(*MQTT3Receiver); !ok {
+			t.Errorf("expected 3.1.1 receiver, got %T", recv)
+		}
+	})
+
+	// Connection errors are not a reason to fall back to 3.1.1
+	t.Run("connection closed", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		var mu sync.Mutex
+		accepted := 0
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+				conn.Close()
+			}
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, err = NewMQTTReceiver(ctx, "tcp://"+ln.Addr().String(), []string{"a/b"})
+		if err == nil || errors.Is(err, errProtocolVersion) {
+			t.Errorf("expected connection error, got %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if accepted != 1 {
+			t.Errorf("expected 1 connection, got %d", accepted)
+		}
+	})
+}
+
+func TestMQTTReceiverWebsocket(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		t.Run(fmt.Sprintf("secure=%v", secure), func(t *testing.T) {
+			broker := newFakeWSBroker(t, secure)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := []MQTTReceiverOpt{WithHeaders(http.Header{"X-Token": {"abc"}})}
+			if secure {
+				opts = append(opts, WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+			}
+			recv, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b"}, opts...)
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			broker.waitSubscribed(t)
+
+			broker.publish("a/b", []byte(`{"baseUrl": "https://host", "relPath": "/file.bufr"}`))
+			if !recv.Next() {
+				t.Fatalf("expected a message")
+			}
+			if recv.Message().Topic != "a/b" {
+				t.Errorf("unexpected topic %s", recv.Message().Topic)
+			}
+			broker.mu.Lock()
+			if broker.header.Get("X-Token") != "abc" {
+				t.Errorf("expected custom header, got %v", broker.header)
+			}
+			broker.mu.Unlock()
+		})
+	}
+}
+
+func TestMQTTReceiverShareGroup(t *testing.T) {
+	for _, v3 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v3=%v", v3), func(t *testing.T) {
+			broker := newFakeBroker(t, v3)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			recv, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b"}, WithShareGroup("ingest"))
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			broker.waitSubscribed(t)
+			broker.mu.Lock()
+			if len(broker.subscriptions) != 1 || broker.subscriptions[0] != "$share/ingest/a/b" {
+				t.Errorf("expected shared subscription, got %v", broker.subscriptions)
+			}
+			broker.mu.Unlock()
+
+			// Messages are published with the original topic
+			broker.publish("a/b", []byte(`{"baseUrl": "https://host", "relPath": "/file.bufr"}`))
+			if !recv.Next() {
+				t.Fatalf("expected a message")
+			}
+			if recv.Message().Topic != "a/b" {
+				t.Errorf("unexpected topic %s", recv.Message().Topic)
+			}
+		})
+	}
+}
+
+func TestMQTTReceiverSession(t *testing.T) {
+	broker := newFakeBroker(t, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b"}, WithClientID("wis2test"), WithSessionExpiry(time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	broker.waitSubscribed(t)
+	broker.mu.Lock()
+	connect := broker.connects[0]
+	if connect.ClientID != "wis2test" {
+		t.Errorf("expected client id wis2test, got %s", connect.ClientID)
+	}
+	if connect.Properties == nil || connect.Properties.SessionExpiryInterval == nil || *connect.Properties.SessionExpiryInterval != 3600 {
+		t.Errorf("expected session expiry of 3600s, got %+v", connect.Properties)
+	}
+	broker.mu.Unlock()
+
+	// An id assigned by the broker is used when reconnecting
+	recv, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b"})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	broker.waitSubscribed(t)
+	if id := recv.(*MQTTReceiver).clientID; id != "assigned" {
+		t.Errorf("expected assigned client id, got %s", id)
+	}
+}
+
+func TestValidateShareGroup(t *testing.T) {
+	for group, valid := range map[string]bool{"ingest": true, "": false, "a/b": false, "a+": false, "#": false} {
+		if err := ValidateShareGroup(group); (err == nil) != valid {
+			t.Errorf("%q: expected valid=%v, got %v", group, valid, err)
+		}
+	}
+}
+
+func TestMQTTReceiverAck(t *testing.T) {
+	for _, v3 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v3=%v", v3), func(t *testing.T) {
+			broker := newFakeBroker(t, v3)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			recv, err := NewMQTTReceiver(ctx, broker.url(), []string{"a/b"})
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			broker.waitSubscribed(t)
+
+			acks := func() []uint16 {
+				broker.mu.Lock()
+				defer broker.mu.Unlock()
+				return append([]uint16{}, broker.acks...)
+			}
+
+			waitAcks := func(n int) []uint16 {
+				deadline := time.Now().Add(5 * time.Second)
+				for len(acks()) < n && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return acks()
+			}
+
+			broker.publishQoS("a/b", []byte(`{"baseUrl": "https://host", "relPath": "/file.bufr"}`), 1, 1)
+			if !recv.Next() {
+				t.Fatalf("expected a message")
+			}
+			time.Sleep(200 * time.Millisecond)
+			if got := acks(); len(got) != 0 {
+				t.Fatalf("expected no acknowledgement before Ack, got %v", got)
+			}
+			if err := recv.Message().Ack(); err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+			if got := waitAcks(1); len(got) != 1 || got[0] != 1 {
+				t.Fatalf("expected message to be acknowledged, got %v", got)
+			}
+
+			// Undecodable messages are acknowledged
+			body := []byte(`{"baseUrl": "https://host", "relPath": "/file.bufr"}`)
+			broker.publishQoS("a/b", []byte("{"), 1, 2)
+			broker.publishQoS("a/b", body, 1, 3)
+			if !recv.Next() {
+				t.Fatalf("expected a message")
+			}
+			first := recv.Message()
+			if got := waitAcks(2); len(got) != 2 || got[1] != 2 {
+				t.Errorf("expected undecodable message to be acknowledged, got %v", got)
+			}
+
+			// Acknowledgements are sent in the order messages were received
+			broker.publishQoS("a/b", body, 1, 4)
+			if !recv.Next() {
+				t.Fatalf("expected a message")
+			}
+			recv.Message().Ack()
+			time.Sleep(200 * time.Millisecond)
+			if got := acks(); len(got) != 2 {
+				t.Fatalf("expected no acknowledgement before earlier messages, got %v", got)
+			}
+			first.Ack()
+			if got := waitAcks(4); len(got) != 4 || got[2] != 3 || got[3] != 4 {
+				t.Errorf("expected acknowledgements in order, got %v", got)
+			}
+		})
+	}
+}
+
+func TestWithEnvCredentials(t *testing.T) {
+	t.Setenv("WIS_USER", "old-user")
+	t.Setenv("WIS_PASSWD", "old-passwd")
+	t.Setenv("WIS2_USER", "user")
+
+	recv := &MQTTReceiver{}
+	WithEnvCredentials("WIS")(recv)
+	WithEnvCredentials("WIS2")(recv)
+	if recv.user != "user" || recv.passwd != "old-passwd" {
+		t.Errorf("expected user=user passwd=old-passwd, got user=%s passwd=%s", recv.user, recv.passwd)
+	}
+}
+
+func TestMQTTReceiverCredentials(t *testing.T) {
+	for _, v3 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v3=%v", v3), func(t *testing.T) {
+			tests := []struct {
+				Name           string
+				Env            bool
+				User, Password string
+			}{
+				{"url", false, "url-user", "url-passwd"},
+				{"env overrides url", true, "env-user", "url-passwd"},
+			}
+			for _, test := range tests {
+				t.Run(test.Name, func(t *testing.T) {
+					broker := newFakeBroker(t, v3)
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					opts := []MQTTReceiverOpt{}
+					if test.Env {
+						t.Setenv("TEST_USER", "env-user")
+						opts = append(opts, WithEnvCredentials("TEST"))
+					}
+
+					brokerURL := strings.Replace(broker.url(), "tcp://", "tcp://url-user:url-passwd@", 1)
+					recv, err := NewMQTTReceiver(ctx, brokerURL, []string{"a/b"}, opts...)
+					if err != nil {
+						t.Fatalf("expected no error, got %s", err)
+					}
+					if _, ok := recv.(*MQTT3Receiver); ok != v3 {
+						t.Fatalf("expected 3.1.1 receiver=%v, got %T", v3, recv)
+					}
+					broker.mu.Lock()
+					defer broker.mu.Unlock()
+					c := broker.connects[len(broker.connects)-1]
+					if c.Username != test.User || string(c.Password) != test.Password {
+						t.Errorf("expected %s:%s, got %s:%s", test.User, test.Password, c.Username, c.Password)
+					}
+				})
+			}
+		})
+	}
+}
+
+// fakeMessage is an mqtt.Message counting acknowledgements.
+type fakeMessage struct {
+	mqtt3.Message
+	acks *int
+}
+
+func (m *fakeMessage) Ack() { *m.acks++ }
+
+func TestPublishQueue(t *testing.T) {
+	acks := 0
+	open := func() bool { return true }
+	q := newPublishQueue(2)
+	q.push(context.Background(), open, &fakeMessage{acks: &acks})
+	q.push(context.Background(), open, &fakeMessage{acks: &acks})
+
+	// A full queue waits for space
+	pushed := make(chan struct{})
+	go func() {
+		q.push(context.Background(), open, &fakeMessage{acks: &acks})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatalf("expected push to wait while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first := q.pop()
+	q.ack(first)
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected push once there is space")
+	}
+	if acks != 1 {
+		t.Errorf("expected 1 ack, got %d", acks)
+	}
+
+	// Publishes from before reconnecting are not acknowledged
+	stale := q.pop()
+	q.reset()
+	q.ack(stale)
+	if acks != 1 {
+		t.Errorf("expected stale publish not to be acknowledged, got %d acks", acks)
+	}
+	if q.pop() != nil {
+		t.Errorf("expected queue to be empty after reset")
+	}
+
+	// A full queue stops waiting if the connection is closed
+	q.push(context.Background(), open, &fakeMessage{acks: &acks})
+	q.push(context.Background(), open, &fakeMessage{acks: &acks})
+	closed := func() bool { return false }
+	done := make(chan struct{})
+	go func() {
+		q.push(context.Background(), closed, &fakeMessage{acks: &acks})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected push to return once the connection is closed")
+	}
+}
@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatefulReceiver is a Receiver that can report the state of its connection.
+type StatefulReceiver interface {
+	Receiver
+	State() ConnState
+}
+
+type MultiReceiverOpt func(*MultiReceiver)
+
+// WithFailover treats the first receiver as the primary and the rest as hot
+// standbys in order of preference. Standbys remain connected, but their
+// messages are only used while all preferred receivers are disconnected.
+func WithFailover(failover bool) MultiReceiverOpt {
+	return func(r *MultiReceiver) {
+		r.failover = failover
+	}
+}
+
+// WithFailoverWindow sets how long messages from standbys are kept while a
+// preferred receiver is connected, so messages a standby receives while a
+// disconnect is being detected are used after failing over rather than lost.
+// The default is 1 minute.
+func WithFailoverWindow(window time.Duration) MultiReceiverOpt {
+	return func(r *MultiReceiver) {
+		r.window = window
+	}
+}
+
+// WithDedupWindow sets how long messages are remembered to drop duplicates
+// received from more than one receiver. The default is 10 minutes.
+func WithDedupWindow(window time.Duration) MultiReceiverOpt {
+	return func(r *MultiReceiver) {
+		r.seen = NewMemorySeenStore(window)
+	}
+}
+
+type sourcedMessage struct {
+	idx      int
+	msg      *Message
+	received time.Time
+}
+
+// heldCopies are copies of a message received while it is being processed.
+type heldCopies struct {
+	copies []sourcedMessage
+}
+
+// MultiReceiver merges the messages from multiple receivers, e.g., a receiver
+// for each WIS2 Global Broker, dropping messages already received from another
+// receiver. Copies received while a message is being processed are held until
+// it is acknowledged, then dropped, or used if it is not processed. Messages
+// that are not processed are forgotten, so later copies are also used.
+type MultiReceiver struct {
+	log       *log.Logger
+	receivers []Receiver
+	failover  bool
+	window    time.Duration
+	seen      SeenStore
+	// standby are messages from standbys that are not preferred, oldest first
+	standby []sourcedMessage
+
+	ctx  context.Context
+	msgs chan sourcedMessage
+	mu   sync.Mutex
+	errs []error
+	// held are the copies of messages being processed, by message key
+	held map[string]*heldCopies
+	// retry are copies of messages that were not processed
+	retry  []sourcedMessage
+	wake   chan struct{}
+	active int
+	cur    *Message
+}
+
+// NewMultiReceiver starts receiving from all receivers. Next returns false once
+// all receivers are done or ctx is canceled.
+func NewMultiReceiver(ctx context.Context, receivers []Receiver, opts ...MultiReceiverOpt) *MultiReceiver {
+	recv := &MultiReceiver{
+		log:       log.New(os.Stdout, "[brokers] ", log.LstdFlags),
+		receivers: receivers,
+		window:    time.Minute,
+		seen:      NewMemorySeenStore(10 * time.Minute),
+		ctx:       ctx,
+		msgs:      make(chan sourcedMessage),
+		held:      map[string]*heldCopies{},
+		wake:      make(chan struct{}, 1),
+		active:    -1,
+	}
+	for _, o := range opts {
+		o(recv)
+	}
+
+	wg := &sync.WaitGroup{}
+	for i, r := range receivers {
+		wg.Add(1)
+		go recv.receive(wg, i, r)
+	}
+	go func() {
+		wg.Wait()
+		close(recv.msgs)
+	}()
+
+	return recv
+}
+
+func (r *MultiReceiver) receive(wg *sync.WaitGroup, idx int, recv Receiver) {
+	defer wg.Done()
+	for recv.Next() {
+		select {
+		case r.msgs <- sourcedMessage{idx: idx, msg: recv.Message(), received: time.Now()}:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+	if err := recv.Err(); err != nil {
+		r.mu.Lock()
+		r.errs = append(r.errs, err)
+		r.mu.Unlock()
+	}
+}
+
+// preferred returns true if no receiver preferred over receiver idx is connected.
+// Receivers that do not report their state are considered connected.
+func (r *MultiReceiver) preferred(idx int) bool {
+	for _, recv := range r.receivers[:idx] {
+		sr, ok := recv.(StatefulReceiver)
+		if !ok || sr.State() == Connected {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *MultiReceiver) Message() *Message { return r.cur }
+
+// Err returns the first error from any of the receivers.
+func (r *MultiReceiver) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errs) > 0 {
+		return r.errs[0]
+	}
+	return nil
+}
+
+// buffered returns the oldest message from a standby that is now preferred,
+// acknowledging messages older than the failover window.
+func (r *MultiReceiver) buffered() (sourcedMessage, bool) {
+	var found sourcedMessage
+	ok := false
+	kept := r.standby[:0]
+	for _, m := range r.standby {
+		switch {
+		case time.Since(m.received) > r.window:
+			m.msg.Ack()
+		case !ok && r.preferred(m.idx):
+			found, ok = m, true
+		default:
+			kept = append(kept, m)
+		}
+	}
+	r.standby = kept
+	return found, ok
+}
+
+// retried returns the oldest copy of a message that was not processed.
+func (r *MultiReceiver) retried() (sourcedMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.retry) == 0 {
+		return sourcedMessage{}, false
+	}
+	m := r.retry[0]
+	r.retry = r.retry[1:]
+	return m, true
+}
+
+// hold m if a copy with any of keys is being processed, returning false if
+// there is none.
+func (r *MultiReceiver) hold(keys []string, m sourcedMessage) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range keys {
+		if h, ok := r.held[k]; ok {
+			h.copies = append(h.copies, m)
+			return true
+		}
+	}
+	return false
+}
+
+// release the copies held by h for the message with keys once it has been
+// acknowledged, acknowledging them if it was processed or otherwise queueing
+// them to be used.
+func (r *MultiReceiver) release(keys []string, h *heldCopies, processed bool) {
+	r.mu.Lock()
+	for _, k := range keys {
+		if r.held[k] == h {
+			delete(r.held, k)
+		}
+	}
+	copies := h.copies
+	h.copies = nil
+	if !processed {
+		r.retry = append(r.retry, copies...)
+	}
+	r.mu.Unlock()
+
+	if processed {
+		for _, c := range copies {
+			c.msg.Ack()
+		}
+	} else if len(copies) > 0 {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *MultiReceiver) Next() bool {
+	for {
+		m, ok := r.retried()
+		if !ok {
+			m, ok = r.buffered()
+		}
+		if !ok {
+			// Buffered messages are checked periodically in case the preferred
+			// receivers disconnect
+			var check <-chan time.Time
+			if len(r.standby) > 0 {
+				check = time.After(time.Second)
+			}
+			select {
+			case m, ok = <-r.msgs:
+			case <-r.wake:
+				continue
+			case <-check:
+				continue
+			case <-r.ctx.Done():
+			}
+			if !ok {
+				r.cur = nil
+				return false
+			}
+			if r.failover && !r.preferred(m.idx) {
+				r.standby = append(r.standby, m)
+				continue
+			}
+		}
+		if r.failover && m.idx != r.active {
+			r.log.Printf("receiving from %s", m.msg.Source)
+			r.active = m.idx
+		}
+		keys := MessageKeys(m.msg)
+		seen, err := r.seen.Seen(keys...)
+		if err != nil {
+			r.log.Printf("failed to execute seen check: %s", err)
+		}
+		if seen {
+			if !r.hold(keys, m) {
+				m.msg.Ack()
+			}
+			continue
+		}
+
+		h := &heldCopies{}
+		r.mu.Lock()
+		for _, k := range keys {
+			r.held[k] = h
+		}
+		r.mu.Unlock()
+		ack := m.msg.ack
+		m.msg.ack = func(ok bool) error {
+			var err error
+			if ok {
+				err = r.seen.Done(keys...)
+			} else {
+				err = r.seen.Forget(keys...)
+			}
+			if err != nil {
+				r.log.Printf("failed to update seen: %s", err)
+			}
+			r.release(keys, h, ok)
+			if ack == nil {
+				return nil
+			}
+			return ack(ok)
+		}
+		r.cur = m.msg
+		return true
+	}
+}
+
+var _ Receiver = (*MultiReceiver)(nil)
+var _ StatefulReceiver = (*MQTTReceiver)(nil)
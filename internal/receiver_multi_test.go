@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanReceiver is a Receiver for messages sent on a channel.
+type chanReceiver struct {
+	msgs  chan *Message
+	err   error
+	cur   *Message
+	mu    sync.Mutex
+	state ConnState
+}
+
+func newChanReceiver() *chanReceiver {
+	return &chanReceiver{msgs: make(chan *Message), state: Connected}
+}
+
+func (r *chanReceiver) Next() bool {
+	var ok bool
+	r.cur, ok = <-r.msgs
+	return ok
+}
+func (r *chanReceiver) Message() *Message { return r.cur }
+func (r *chanReceiver) Err() error        { return r.err }
+func (r *chanReceiver) State() ConnState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+func (r *chanReceiver) setState(s ConnState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = s
+}
+
+func TestMultiReceiver(t *testing.T) {
+	var mu sync.Mutex
+	acked := 0
+	newMsg := func(id, source string) *Message {
+		msg := &Message{Source: source, Payload: WISMessage{ID: id}}
+		msg.SetAck(func(bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			acked++
+			return nil
+		})
+		return msg
+	}
+
+	t.Run("dedup", func(t *testing.T) {
+		a, b := newChanReceiver(), newChanReceiver()
+		b.err = errors.New("b failed")
+		recv := NewMultiReceiver(context.Background(), []Receiver{a, b})
+
+		go func() {
+			a.msgs <- newMsg("1", "a")
+			b.msgs <- newMsg("1", "b")
+			b.msgs <- newMsg("2", "b")
+			a.msgs <- newMsg("2", "a")
+			a.msgs <- newMsg("3", "a")
+			close(a.msgs)
+			close(b.msgs)
+		}()
+
+		ids := []string{}
+		for recv.Next() {
+			ids = append(ids, recv.Message().Payload.ID)
+			recv.Message().Ack()
+		}
+		if len(ids) != 3 || ids[0] != "1" || ids[1] != "2" || ids[2] != "3" {
+			t.Errorf("unexpected messages %v", ids)
+		}
+		if recv.Err() == nil || recv.Err().Error() != "b failed" {
+			t.Errorf("expected receiver error, got %v", recv.Err())
+		}
+		mu.Lock()
+		if acked != 5 {
+			t.Errorf("expected the 3 messages and 2 duplicates to be acknowledged, got %d", acked)
+		}
+		mu.Unlock()
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		primary, standby := newChanReceiver(), newChanReceiver()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		recv := NewMultiReceiver(ctx, []Receiver{primary, standby}, WithFailover(true))
+
+		next := func() *Message {
+			t.Helper()
+			if !recv.Next() {
+				t.Fatal("expected a message")
+			}
+			return recv.Message()
+		}
+
+		// standby messages are not used while the primary is connected. Each send
+		// to a receiver completes once its previous message was taken by Next.
+		go func() {
+			standby.msgs <- newMsg("1", "standby")
+			standby.msgs <- newMsg("2", "standby")
+			primary.msgs <- newMsg("1", "primary")
+		}()
+		if msg := next(); msg.Source != "primary" {
+			t.Errorf("expected message from primary, got %s", msg.Source)
+		}
+
+		// standby messages received before the primary disconnect is detected
+		// are used after failing over
+		primary.setState(Disconnected)
+		if msg := next(); msg.Payload.ID != "2" || msg.Source != "standby" {
+			t.Errorf("expected buffered standby message 2 after failover, got %+v", msg)
+		}
+		go func() { standby.msgs <- newMsg("3", "standby") }()
+		if msg := next(); msg.Payload.ID != "3" || msg.Source != "standby" {
+			t.Errorf("expected standby message 3 after failover, got %+v", msg)
+		}
+
+		cancel()
+		if recv.Next() {
+			t.Errorf("expected Next to return false after cancel")
+		}
+	})
+
+	t.Run("failover window", func(t *testing.T) {
+		primary, standby := newChanReceiver(), newChanReceiver()
+		primary.setState(Disconnected)
+		recv := NewMultiReceiver(context.Background(), []Receiver{primary, standby}, WithFailover(true))
+		recv.standby = []sourcedMessage{
+			{idx: 1, msg: newMsg("1", "standby"), received: time.Now().Add(-2 * time.Minute)},
+			{idx: 1, msg: newMsg("2", "standby"), received: time.Now()},
+		}
+
+		if !recv.Next() || recv.Message().Payload.ID != "2" {
+			t.Errorf("expected standby message older than the window to be dropped, got %+v", recv.Message())
+		}
+	})
+
+	t.Run("nack", func(t *testing.T) {
+		a, b := newChanReceiver(), newChanReceiver()
+		recv := NewMultiReceiver(context.Background(), []Receiver{a, b})
+
+		go func() {
+			a.msgs <- newMsg("1", "a")
+			b.msgs <- newMsg("1", "b")
+			close(a.msgs)
+			close(b.msgs)
+		}()
+
+		if !recv.Next() {
+			t.Fatalf("expected a message")
+		}
+		first := recv.Message().Source
+		recv.Message().Nack()
+		if !recv.Next() || recv.Message().Source == first {
+			t.Fatalf("expected copy from the other receiver after nack, got %+v", recv.Message())
+		}
+		recv.Message().Ack()
+		if recv.Next() {
+			t.Errorf("expected no more messages")
+		}
+	})
+
+	// Copies received while the first is processed are held until it is
+	// acknowledged
+	t.Run("held copy", func(t *testing.T) {
+		for _, processed := range []bool{false, true} {
+			a, b := newChanReceiver(), newChanReceiver()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			recv := NewMultiReceiver(ctx, []Receiver{a, b})
+
+			// Each send to b completes once its previous message was taken by Next
+			go func() {
+				a.msgs <- newMsg("1", "a")
+				b.msgs <- newMsg("1", "b")
+				b.msgs <- newMsg("2", "b")
+				b.msgs <- newMsg("3", "b")
+			}()
+			if !recv.Next() || recv.Message().Payload.ID != "1" {
+				t.Fatalf("expected message 1, got %+v", recv.Message())
+			}
+			first := recv.Message()
+			if !recv.Next() || recv.Message().Payload.ID != "2" {
+				t.Fatalf("expected message 2, got %+v", recv.Message())
+			}
+
+			mu.Lock()
+			before := acked
+			mu.Unlock()
+			if processed {
+				first.Ack()
+				if !recv.Next() || recv.Message().Payload.ID != "3" {
+					t.Errorf("expected held copy to be dropped, got %+v", recv.Message())
+				}
+				mu.Lock()
+				if acked != before+2 {
+					t.Errorf("expected message and held copy to be acknowledged, got %d acks", acked-before)
+				}
+				mu.Unlock()
+			} else {
+				first.Nack()
+				if !recv.Next() || recv.Message().Payload.ID != "1" || recv.Message().Source == first.Source {
+					t.Errorf("expected held copy after nack, got %+v", recv.Message())
+				}
+			}
+		}
+	})
+}
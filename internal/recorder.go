@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record is a raw notification as received from a broker. Records can be
+// replayed using a FileReceiver.
+type Record struct {
+	Topic    string    `json:"topic"`
+	Received time.Time `json:"received"`
+	Source   string    `json:"source"`
+	QoS      byte      `json:"qos"`
+	Retain   bool      `json:"retain,omitempty"`
+	// Properties are the MQTT v5 publish properties, if any.
+	Properties *RecordProperties `json:"properties,omitempty"`
+	// Notification is the payload if it is valid JSON, otherwise the payload is
+	// in Payload.
+	Notification json.RawMessage `json:"notification,omitempty"`
+	Payload      []byte          `json:"payload,omitempty"`
+}
+
+type RecordProperties struct {
+	ContentType     string      `json:"contentType,omitempty"`
+	PayloadFormat   *byte       `json:"payloadFormat,omitempty"`
+	MessageExpiry   *uint32     `json:"messageExpiry,omitempty"`
+	ResponseTopic   string      `json:"responseTopic,omitempty"`
+	CorrelationData []byte      `json:"correlationData,omitempty"`
+	User            [][2]string `json:"user,omitempty"`
+}
+
+// NewRecord returns a record for payload received now on topic from source.
+func NewRecord(source, topic string, payload []byte) *Record {
+	rec := &Record{
+		Topic:    topic,
+		Received: time.Now().UTC(),
+		Source:   source,
+	}
+	if json.Valid(payload) {
+		rec.Notification = payload
+	} else {
+		rec.Payload = payload
+	}
+	return rec
+}
+
+// readRecord returns body as a Record if it is one, otherwise a Record for
+// body as a raw notification on topic with a zero receive time.
+func readRecord(topic string, body []byte) *Record {
+	rec := &Record{}
+	if err := json.Unmarshal(body, rec); err == nil && (len(rec.Notification) > 0 || len(rec.Payload) > 0) {
+		return rec
+	}
+	return &Record{Topic: topic, Payload: body}
+}
+
+// body returns the notification as received.
+func (r *Record) body() []byte {
+	if len(r.Notification) > 0 {
+		return r.Notification
+	}
+	return r.Payload
+}
+
+func (r *Record) contentType() string {
+	if r.Properties == nil {
+		return ""
+	}
+	return r.Properties.ContentType
+}
+
+type RecorderOpt func(*Recorder)
+
+// WithRecordMaxSize sets the size in bytes after which a new recording file is
+// started. The default is 100MB.
+func WithRecordMaxSize(size int64) RecorderOpt {
+	return func(r *Recorder) {
+		r.maxSize = size
+	}
+}
+
+// WithRecordMaxAge sets how long records are written to a recording file
+// before a new file is started. The default is 1 hour.
+func WithRecordMaxAge(age time.Duration) RecorderOpt {
+	return func(r *Recorder) {
+		r.maxAge = age
+	}
+}
+
+// Recorder writes records to gzip compressed JSON lines files in a directory,
+// starting a new file when the current file reaches a maximum size or age.
+// Files are named by the time they were started so they sort in the order
+// they were written.
+type Recorder struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	f       *os.File
+	cw      *countingWriter
+	zw      *gzip.Writer
+	started time.Time
+}
+
+// NewRecorder records to files in dir, which must exist.
+func NewRecorder(dir string, opts ...RecorderOpt) (*Recorder, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	r := &Recorder{
+		dir:     dir,
+		maxSize: 100 * 1024 * 1024,
+		maxAge:  time.Hour,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r, nil
+}
+
+// Record writes rec to the current file. Each record is flushed so files can
+// be read while they are being written.
+func (r *Recorder) Record(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil && (r.cw.n >= r.maxSize || time.Since(r.started) >= r.maxAge) {
+		if err := r.close(); err != nil {
+			return err
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.zw.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return r.zw.Flush()
+}
+
+func (r *Recorder) open() error {
+	now := time.Now().UTC()
+	name := "wis2-" + now.Format("20060102T150405.000000000Z") + ".jsonl.gz"
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating record file: %w", err)
+	}
+	r.f = f
+	r.cw = &countingWriter{w: f}
+	r.zw = gzip.NewWriter(r.cw)
+	r.started = now
+	return nil
+}
+
+func (r *Recorder) close() error {
+	if r.f == nil {
+		return nil
+	}
+	zerr := r.zw.Close()
+	ferr := r.f.Close()
+	r.f = nil
+	if zerr != nil {
+		return zerr
+	}
+	return ferr
+}
+
+// Close the current file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// record writes rec using recorder, logging any error rather than failing to
+// receive.
+func record(log *log.Logger, recorder *Recorder, rec *Record) {
+	if err := recorder.Record(rec); err != nil {
+		log.Printf("failed to record message on topic '%s': %s", rec.Topic, err)
+	}
+}
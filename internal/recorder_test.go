@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(dir, WithRecordMaxSize(1))
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	rec := NewRecord("tcp://broker", "a/b", []byte(`{"baseUrl": "https://host", "relPath": "/1.bufr"}`))
+	rec.Properties = &RecordProperties{ContentType: "application/json", User: [][2]string{{"key", "value"}}}
+	if err := recorder.Record(rec); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if err := recorder.Record(NewRecord("tcp://broker", "a/c", []byte("not json"))); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	// Files are readable before the recorder is closed
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl.gz"))
+	if len(files) != 2 {
+		t.Fatalf("expected a file per record, got %v", files)
+	}
+	f, err := os.Open(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Record
+	if err := json.NewDecoder(zr).Decode(&got); err != nil {
+		t.Fatalf("failed to decode record: %s", err)
+	}
+	if got.Topic != "a/c" || string(got.Payload) != "not json" || got.Notification != nil {
+		t.Errorf("unexpected record %+v", got)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+
+	// The recording can be replayed
+	recv, err := NewFileReceiver(context.Background(), "file://"+dir, []string{"#"})
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if !recv.Next() {
+		t.Fatalf("expected a message")
+	}
+	if msg := recv.Message(); msg.Topic != "a/b" || msg.Payload.RelPath != "/1.bufr" || !msg.Received.Equal(rec.Received) {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if recv.Next() {
+		t.Errorf("expected undecodable record to be skipped")
+	}
+}
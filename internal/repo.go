@@ -1,41 +1,259 @@
 package internal
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
 )
 
+// SidecarSuffix is appended to the name of a stored file to create the name of
+// its sidecar metadata file.
+const SidecarSuffix = ".wnm.json"
+
 type Repo interface {
-	Store(topic, src string) (string, error)
+	// Store moves the file at src into the repo for topic, returning the path of
+	// the stored file. It is an error if the file already exists. msg is the
+	// message that caused the file to be stored, if any, and may be used to write
+	// sidecar metadata.
+	Store(topic, src string, msg *Message) (string, error)
+	// Replace is the same as Store but replaces any existing file.
+	Replace(topic, src string, msg *Message) (string, error)
+	// Delete removes the file with name from the repo for topic, returning the
+	// path of the removed file.
+	Delete(topic, name string) (string, error)
 	Get(topic, name string) (*os.File, error)
 	Exists(topic, name string) (bool, error)
+	// Sidecar returns the metadata stored with the file with name, or an error
+	// wrapping os.ErrNotExist if there is none.
+	Sidecar(topic, name string) (*Sidecar, error)
+}
+
+// Sidecar is the metadata for the message that caused a file to be stored.
+type Sidecar struct {
+	Topic    string     `json:"topic"`
+	Source   string     `json:"source,omitempty"`
+	Received time.Time  `json:"received"`
+	Format   string     `json:"format,omitempty"`
+	Message  WISMessage `json:"message"`
+	// Notification is the message as received, if it was JSON.
+	Notification json.RawMessage `json:"notification,omitempty"`
+}
+
+func newSidecar(msg *Message) *Sidecar {
+	sc := &Sidecar{
+		Topic:    msg.Topic,
+		Source:   msg.Source,
+		Received: msg.Received,
+		Format:   msg.Format,
+		Message:  msg.Payload,
+	}
+	if json.Valid(msg.Raw) {
+		sc.Notification = msg.Raw
+	}
+	return sc
 }
 
 type FSRepo struct {
-	root string
+	root     string
+	layout   *template.Template
+	sidecars bool
+}
+
+type RepoOpt func(*FSRepo) error
+
+// WithLayout sets a text/template used to create the directory, relative to the
+// repo root, for files from a topic. The template is executed with the *Topic
+// parsed from the topic, e.g., {{.CentreID}}/{{.Discipline}}/{{.Subtopic}}.
+// Topics that are not WIS2 topics are stored in directories matching the topic.
+func WithLayout(layout string) RepoOpt {
+	return func(fs *FSRepo) error {
+		tmpl, err := template.New("layout").Option("missingkey=error").Parse(layout)
+		if err != nil {
+			return fmt.Errorf("invalid layout: %w", err)
+		}
+		fs.layout = tmpl
+		return nil
+	}
 }
 
-func (fs *FSRepo) path(topic, name string) string {
-	return filepath.Join(fs.root, topic, filepath.Base(name))
+// WithSidecars enables writing sidecar metadata files alongside stored files.
+func WithSidecars(b bool) RepoOpt {
+	return func(fs *FSRepo) error {
+		fs.sidecars = b
+		return nil
+	}
 }
 
-func (fs *FSRepo) Store(topic, fpath string) (string, error) {
+// dir returns the directory for files from topic, or an error if the layout
+// fails or it is not below the repo root, e.g., if the topic has .. levels.
+func (fs *FSRepo) dir(topic string) (string, error) {
+	if fs.layout != nil {
+		if t, err := ParseTopic(topic); err == nil {
+			buf := &strings.Builder{}
+			if err := fs.layout.Execute(buf, t); err != nil {
+				return "", fmt.Errorf("executing layout for topic '%s': %w", topic, err)
+			}
+			topic = buf.String()
+		}
+	}
 	dir := filepath.Join(fs.root, filepath.FromSlash(topic))
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+	rel, err := filepath.Rel(fs.root, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid topic '%s': not a directory in the repo", topic)
+	}
+	return dir, nil
+}
+
+func (fs *FSRepo) path(topic, name string) (string, error) {
+	dir, err := fs.dir(topic)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(name)), nil
+}
+
+func (fs *FSRepo) Store(topic, fpath string, msg *Message) (string, error) {
+	exists, err := fs.Exists(topic, fpath)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		dstPath, _ := fs.path(topic, fpath)
+		return "", fmt.Errorf("%s: %w", dstPath, os.ErrExist)
+	}
+	return fs.install(topic, fpath, msg, false)
+}
+
+func (fs *FSRepo) Replace(topic, fpath string, msg *Message) (string, error) {
+	return fs.install(topic, fpath, msg, true)
+}
+
+// install moves fpath into the repo. If replace is false, the file is linked
+// rather than renamed where possible so that if multiple processes sharing the
+// repo store the same file concurrently only one will succeed.
+//
+// The sidecar is written to a temporary file first and only renamed into place
+// once the file has been stored, so a store that fails, or loses a race, does
+// not change the sidecar of an existing file.
+func (fs *FSRepo) install(topic, fpath string, msg *Message, replace bool) (string, error) {
+	dstPath, err := fs.path(topic, fpath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return "", err
+	}
+
+	var sidecarTmp string
+	if fs.sidecars && msg != nil {
+		sidecarTmp, err = writeSidecar(dstPath+SidecarSuffix, newSidecar(msg))
+		if err != nil {
+			return "", fmt.Errorf("writing sidecar: %w", err)
+		}
+		defer os.Remove(sidecarTmp)
+	}
+	if err := fs.move(fpath, dstPath, replace); err != nil {
 		return "", err
 	}
-	dstPath := fs.path(topic, fpath)
-	return dstPath, os.Rename(fpath, dstPath)
+	if sidecarTmp != "" {
+		if err := os.Rename(sidecarTmp, dstPath+SidecarSuffix); err != nil {
+			return dstPath, fmt.Errorf("writing sidecar: %w", err)
+		}
+	}
+	return dstPath, nil
+}
+
+// move fpath to dstPath, returning an error wrapping os.ErrExist if replace is
+// false and dstPath exists.
+func (fs *FSRepo) move(fpath, dstPath string, replace bool) error {
+	if !replace {
+		err := os.Link(fpath, dstPath)
+		if err == nil {
+			os.Remove(fpath)
+			return nil
+		}
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s: %w", dstPath, os.ErrExist)
+		}
+		// Fall back to rename if links are not supported
+	}
+	return os.Rename(fpath, dstPath)
+}
+
+// writeSidecar writes the sidecar for fpath to a temporary file in the same
+// directory, returning its path, so it can be renamed to fpath atomically.
+func writeSidecar(fpath string, sc *Sidecar) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(fpath), "."+filepath.Base(fpath)+".*")
+	if err != nil {
+		return "", err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(sc); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Delete removes the file with name. Since the name is usually taken from a
+// message, names that are not a single path element are rejected rather than
+// reduced to their base name.
+func (fs *FSRepo) Delete(topic, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid name '%s'", name)
+	}
+	dstPath, err := fs.path(topic, name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Remove(dstPath + SidecarSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return dstPath, err
+	}
+	return dstPath, os.Remove(dstPath)
+}
+
+func (fs *FSRepo) Sidecar(topic, name string) (*Sidecar, error) {
+	fpath, err := fs.path(topic, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fpath + SidecarSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := &Sidecar{}
+	if err := json.NewDecoder(f).Decode(sc); err != nil {
+		return nil, fmt.Errorf("decoding sidecar: %w", err)
+	}
+	return sc, nil
 }
 
 func (fs *FSRepo) Get(topic, name string) (*os.File, error) {
-	return os.Open(fs.path(topic, name))
+	fpath, err := fs.path(topic, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fpath)
 }
 
 func (fs *FSRepo) Exists(topic, name string) (bool, error) {
-	_, err := fs.Get(topic, name)
+	fpath, err := fs.path(topic, name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fpath)
 	if errors.Is(err, os.ErrNotExist) {
 		return false, nil
 	}
@@ -47,7 +265,7 @@ func (fs *FSRepo) Exists(topic, name string) (bool, error) {
 
 var _ Repo = (*FSRepo)(nil)
 
-func NewRepo(path string) (Repo, error) {
+func NewRepo(path string, opts ...RepoOpt) (Repo, error) {
 	st, err := os.Stat(path)
 	if err != nil {
 		return nil, err
@@ -55,5 +273,11 @@ func NewRepo(path string) (Repo, error) {
 	if !st.IsDir() {
 		return nil, fmt.Errorf("path is not a dir")
 	}
-	return &FSRepo{root: path}, nil
+	repo := &FSRepo{root: path}
+	for _, o := range opts {
+		if err := o(repo); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
 }
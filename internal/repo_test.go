@@ -2,10 +2,13 @@ package internal
 
 import (
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func fixtureDir(t *testing.T) (string, func()) {
@@ -51,7 +54,7 @@ func TestFSRepo(t *testing.T) {
 	}
 
 	t.Run("Store", func(t *testing.T) {
-		gotPath, err := repo.Store("foo/goo", f.Name())
+		gotPath, err := repo.Store("foo/goo", f.Name(), nil)
 		if err != nil {
 			t.Errorf("failed to store file: %s", err)
 		}
@@ -93,4 +96,243 @@ func TestFSRepo(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("Store existing is error", func(t *testing.T) {
+		g, cleanup := fixtureFile(t)
+		defer cleanup()
+		if err := os.Rename(g.Name(), filepath.Join(filepath.Dir(g.Name()), filepath.Base(f.Name()))); err != nil {
+			t.Fatalf("failed to rename fixture: %s", err)
+		}
+		_, err := repo.Store("foo/goo", f.Name(), nil)
+		if !errors.Is(err, os.ErrExist) {
+			t.Errorf("expected exists error, got %v", err)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		g, cleanup := fixtureFile(t)
+		defer cleanup()
+		src := filepath.Join(filepath.Dir(g.Name()), filepath.Base(f.Name()))
+		if err := os.Rename(g.Name(), src); err != nil {
+			t.Fatalf("failed to rename fixture: %s", err)
+		}
+		gotPath, err := repo.Replace("foo/goo", src, nil)
+		if err != nil {
+			t.Errorf("failed to replace file: %s", err)
+		}
+		expectedPath := filepath.Join(dir, "foo/goo", filepath.Base(f.Name()))
+		if expectedPath != gotPath {
+			t.Errorf("got path %s, expected %s", gotPath, expectedPath)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		gotPath, err := repo.Delete("foo/goo", filepath.Base(f.Name()))
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+		expectedPath := filepath.Join(dir, "foo/goo", filepath.Base(f.Name()))
+		if expectedPath != gotPath {
+			t.Errorf("got path %s, expected %s", gotPath, expectedPath)
+		}
+		exists, err := repo.Exists("foo/goo", f.Name())
+		if err != nil || exists {
+			t.Errorf("expected file to not exist after delete, got exists=%v err=%v", exists, err)
+		}
+	})
+}
+
+func TestFSRepoLayout(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+	f, cleanup := fixtureFile(t)
+	defer cleanup()
+
+	repo, err := NewRepo(dir, WithLayout("{{.CentreID}}/{{.Discipline}}/{{.Subtopic}}"))
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+	gotPath, err := repo.Store("origin/a/wis2/ca-eccc-msc/data/core/weather/synop", f.Name(), nil)
+	if err != nil {
+		t.Errorf("failed to store file: %s", err)
+	}
+	expectedPath := filepath.Join(dir, "ca-eccc-msc/weather/synop", filepath.Base(f.Name()))
+	if expectedPath != gotPath {
+		t.Errorf("got path %s, expected %s", gotPath, expectedPath)
+	}
+
+	t.Run("non-WIS2 topic", func(t *testing.T) {
+		g, cleanup := fixtureFile(t)
+		defer cleanup()
+		gotPath, err := repo.Store("foo/goo", g.Name(), nil)
+		if err != nil {
+			t.Errorf("failed to store file: %s", err)
+		}
+		expectedPath := filepath.Join(dir, "foo/goo", filepath.Base(g.Name()))
+		if expectedPath != gotPath {
+			t.Errorf("got path %s, expected %s", gotPath, expectedPath)
+		}
+	})
+
+	t.Run("invalid layout", func(t *testing.T) {
+		if _, err := NewRepo(dir, WithLayout("{{.Nope")); err == nil {
+			t.Errorf("expected error for invalid layout")
+		}
+	})
+
+	t.Run("layout error", func(t *testing.T) {
+		repo, err := NewRepo(dir, WithLayout("{{.Nope}}"))
+		if err != nil {
+			t.Fatalf("failed to create repo: %s", err)
+		}
+		if _, err := repo.Store("origin/a/wis2/ca-eccc-msc/data/core/weather/synop", f.Name(), nil); err == nil {
+			t.Errorf("expected error if the layout cannot be executed")
+		}
+	})
+}
+
+func TestFSRepoSidecar(t *testing.T) {
+	dir, cleanup := fixtureDir(t)
+	defer cleanup()
+	f, cleanup := fixtureFile(t)
+	defer cleanup()
+
+	repo, err := NewRepo(dir, WithSidecars(true))
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+	msg := &Message{
+		Topic:    "foo/goo",
+		Source:   "ssl://broker",
+		Received: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Format:   "wnm",
+		Payload:  WISMessage{ID: "1234", DataID: "foo/goo/file"},
+		Raw:      []byte(`{"id": "1234"}`),
+	}
+	gotPath, err := repo.Store("foo/goo", f.Name(), msg)
+	if err != nil {
+		t.Fatalf("failed to store file: %s", err)
+	}
+	if _, err := os.Stat(gotPath + SidecarSuffix); err != nil {
+		t.Errorf("expected sidecar to exist: %s", err)
+	}
+
+	sc, err := repo.Sidecar("foo/goo", f.Name())
+	if err != nil {
+		t.Fatalf("failed to read sidecar: %s", err)
+	}
+	if sc.Topic != msg.Topic || sc.Source != msg.Source || !sc.Received.Equal(msg.Received) ||
+		sc.Message.ID != "1234" || sc.Message.DataID != "foo/goo/file" {
+		t.Errorf("unexpected sidecar %+v", sc)
+	}
+	notification := map[string]string{}
+	if err := json.Unmarshal(sc.Notification, &notification); err != nil || notification["id"] != "1234" {
+		t.Errorf("unexpected sidecar notification %s", sc.Notification)
+	}
+
+	if _, err := repo.Delete("foo/goo", filepath.Base(f.Name())); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	if _, err := repo.Sidecar("foo/goo", f.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected sidecar to be deleted, got %v", err)
+	}
+}
+
+func TestFSRepoStoreRace(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewRepo(dir, WithSidecars(true))
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+	fs := repo.(*FSRepo)
+
+	// Simulate two processes sharing the repo that both passed the exists check
+	first := filepath.Join(t.TempDir(), "file")
+	second := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(first, []byte("first"), 0o644)
+	os.WriteFile(second, []byte("second"), 0o644)
+
+	if _, err := fs.install("a/b", first, &Message{Payload: WISMessage{ID: "first"}}, false); err != nil {
+		t.Fatalf("expected first store to succeed, got %s", err)
+	}
+	if _, err := fs.install("a/b", second, &Message{Payload: WISMessage{ID: "second"}}, false); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected second store to fail with ErrExist, got %v", err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "a/b/file"))
+	if string(got) != "first" {
+		t.Errorf("expected first file to be kept, got %s", got)
+	}
+	if _, err := os.Stat(first); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected source file to be removed")
+	}
+	if sc, err := repo.Sidecar("a/b", "file"); err != nil || sc.Message.ID != "first" {
+		t.Errorf("expected sidecar of the first file to be kept, got %+v %v", sc, err)
+	}
+
+	// A failed replace keeps the existing sidecar
+	if _, err := fs.install("a/b", filepath.Join(t.TempDir(), "file"), &Message{Payload: WISMessage{ID: "third"}}, true); err == nil {
+		t.Errorf("expected replace of a missing file to fail")
+	}
+	if sc, err := repo.Sidecar("a/b", "file"); err != nil || sc.Message.ID != "first" {
+		t.Errorf("expected sidecar to be kept after failed replace, got %+v %v", sc, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "a/b"))
+	if len(entries) != 2 {
+		t.Errorf("expected only the file and its sidecar, got %d entries", len(entries))
+	}
+}
+
+func TestFSRepoOutsideRoot(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "repo")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("failed to create repo dir: %s", err)
+	}
+	repo, err := NewRepo(dir, WithLayout("{{.CentreID}}/{{.Subtopic}}"))
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+
+	for _, topic := range []string{"../escaped", "a/../../escaped", "a/..", "origin/a/wis2/../data/core/weather/../../escaped"} {
+		t.Run(topic, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "f.txt")
+			os.WriteFile(src, []byte("data"), 0o644)
+			if _, err := repo.Store(topic, src, nil); err == nil {
+				t.Errorf("expected error storing outside the repo")
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escaped", "f.txt")); err == nil {
+				t.Errorf("expected no file outside the repo")
+			}
+		})
+	}
+}
+
+func TestFSRepoDeleteOutsideRoot(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "repo")
+	if err := os.MkdirAll(filepath.Join(dir, "a/b"), 0o755); err != nil {
+		t.Fatalf("failed to create repo dir: %s", err)
+	}
+	victim := filepath.Join(parent, "victim")
+	os.WriteFile(victim, []byte("data"), 0o644)
+	repo, err := NewRepo(dir)
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+
+	tests := []struct{ Topic, Name string }{
+		{"../..", "victim"},
+		{"a/../..", "victim"},
+		{"a/b", "../../../victim"},
+		{"a/b", ".."},
+		{"a/b", `..\victim`},
+	}
+	for _, test := range tests {
+		if _, err := repo.Delete(test.Topic, test.Name); err == nil {
+			t.Errorf("expected error deleting topic='%s' name='%s'", test.Topic, test.Name)
+		}
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("expected file outside the repo to exist: %s", err)
+	}
 }
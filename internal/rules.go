@@ -0,0 +1,337 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Rule is an include or exclude rule for messages. A rule is one or more
+// clauses joined by &&, all of which must match for the rule to match. Clauses
+// have the form <field> <op> <value>.
+//
+// Fields are topic, id, data_id, metadata_id, filename, media_type, action, size
+// and age, where age is the time since the message pubtime, as well as the WIS2
+// topic levels channel, centre_id, notification_type, data_policy, discipline
+// and subtopic.
+//
+// Operators are = and != for equality, ~ and !~ for regular expression matches,
+// and <, <=, > and >= for size and age. Sizes may use K, M or G suffixes for
+// powers of 1024, e.g., 10M, and ages are Go durations, e.g., 1h30m. Values may
+// be double quoted, and must be if they contain &&.
+type Rule struct {
+	Include bool
+	// Topic is an MQTT topic filter limiting the messages this rule applies to.
+	// Empty applies to all messages.
+	Topic   string
+	Expr    string
+	clauses []clause
+}
+
+func (r *Rule) String() string {
+	kind := "exclude"
+	if r.Include {
+		kind = "include"
+	}
+	if r.Topic != "" {
+		return fmt.Sprintf("[%s] %s %s", r.Topic, kind, r.Expr)
+	}
+	return kind + " " + r.Expr
+}
+
+func (r *Rule) appliesTo(msg *Message) bool {
+	return r.Topic == "" || topicMatches(r.Topic, msg.Topic)
+}
+
+func (r *Rule) matches(msg *Message) bool {
+	for _, c := range r.clauses {
+		if !c.matches(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+type clause struct {
+	field string
+	op    string
+	str   string
+	re    *regexp.Regexp
+	num   int64
+}
+
+var (
+	clausePat = regexp.MustCompile(`^\s*([a-z_]+)\s*(!~|!=|<=|>=|=|~|<|>)\s*(.*?)\s*$`)
+	sizePat   = regexp.MustCompile(`^(\d+)([KMG]?)B?$`)
+)
+
+var ruleFields = map[string]func(*Message) string{
+	"topic":             func(m *Message) string { return m.Topic },
+	"channel":           topicField(func(t *Topic) string { return t.Channel }),
+	"centre_id":         topicField(func(t *Topic) string { return t.CentreID }),
+	"notification_type": topicField(func(t *Topic) string { return t.NotificationType }),
+	"data_policy":       topicField(func(t *Topic) string { return t.DataPolicy }),
+	"discipline":        topicField(func(t *Topic) string { return t.Discipline }),
+	"subtopic":          topicField(func(t *Topic) string { return t.Subtopic() }),
+	"id":                func(m *Message) string { return m.Payload.ID },
+	"data_id":           func(m *Message) string { return m.Payload.DataID },
+	"metadata_id":       func(m *Message) string { return m.Payload.MetadataID },
+	"filename":          func(m *Message) string { return m.Payload.Name() },
+	"action":            func(m *Message) string { return string(m.Payload.Action()) },
+	"media_type": func(m *Message) string {
+		if l := m.Payload.DataLink(); l != nil {
+			return l.Type
+		}
+		return ""
+	},
+}
+
+// topicField returns a field getter for a WIS2 topic level. Topics that are not
+// valid WIS2 topics have empty values.
+func topicField(get func(*Topic) string) func(*Message) string {
+	return func(m *Message) string {
+		t, err := ParseTopic(m.Topic)
+		if err != nil {
+			return ""
+		}
+		return get(t)
+	}
+}
+
+// numeric fields, sizes in bytes and ages in nanoseconds
+var ruleNumFields = map[string]func(*Message) (int64, bool){
+	"size": func(m *Message) (int64, bool) { return m.Payload.Size, m.Payload.Size > 0 },
+	"age": func(m *Message) (int64, bool) {
+		if m.Payload.PubTime == nil {
+			return 0, false
+		}
+		return int64(time.Since(*m.Payload.PubTime)), true
+	},
+}
+
+func parseSize(s string) (int64, error) {
+	m := sizePat.FindStringSubmatch(strings.ToUpper(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch m[2] {
+	case "K":
+		n *= 1 << 10
+	case "M":
+		n *= 1 << 20
+	case "G":
+		n *= 1 << 30
+	}
+	return n, nil
+}
+
+func parseClause(s string) (clause, error) {
+	m := clausePat.FindStringSubmatch(s)
+	if m == nil {
+		return clause{}, fmt.Errorf("invalid clause '%s'", strings.TrimSpace(s))
+	}
+	c := clause{field: m[1], op: m[2], str: m[3]}
+	if strings.HasPrefix(c.str, `"`) {
+		v, err := strconv.Unquote(c.str)
+		if err != nil {
+			return c, fmt.Errorf("invalid quoted value %s", c.str)
+		}
+		c.str = v
+	}
+
+	if _, ok := ruleFields[c.field]; ok {
+		switch c.op {
+		case "~", "!~":
+			re, err := regexp.Compile(c.str)
+			if err != nil {
+				return c, fmt.Errorf("invalid regex for %s: %w", c.field, err)
+			}
+			c.re = re
+		case "=", "!=":
+		default:
+			return c, fmt.Errorf("operator %s not supported for %s", c.op, c.field)
+		}
+		return c, nil
+	}
+
+	if _, ok := ruleNumFields[c.field]; !ok {
+		return c, fmt.Errorf("unknown field '%s'", c.field)
+	}
+	switch c.op {
+	case "~", "!~":
+		return c, fmt.Errorf("operator %s not supported for %s", c.op, c.field)
+	}
+	var err error
+	if c.field == "age" {
+		var d time.Duration
+		d, err = time.ParseDuration(c.str)
+		c.num = int64(d)
+	} else {
+		c.num, err = parseSize(c.str)
+	}
+	if err != nil {
+		return c, fmt.Errorf("invalid value for %s: %w", c.field, err)
+	}
+	return c, nil
+}
+
+func (c clause) matches(msg *Message) bool {
+	if get, ok := ruleFields[c.field]; ok {
+		v := get(msg)
+		switch c.op {
+		case "=":
+			return v == c.str
+		case "!=":
+			return v != c.str
+		case "~":
+			return c.re.MatchString(v)
+		case "!~":
+			return !c.re.MatchString(v)
+		}
+		return false
+	}
+	v, ok := ruleNumFields[c.field](msg)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "=":
+		return v == c.num
+	case "!=":
+		return v != c.num
+	case "<":
+		return v < c.num
+	case "<=":
+		return v <= c.num
+	case ">":
+		return v > c.num
+	case ">=":
+		return v >= c.num
+	}
+	return false
+}
+
+// ParseRule parses a rule expression. topic is an optional MQTT topic filter
+// limiting the messages the rule applies to.
+func ParseRule(include bool, topic, expr string) (*Rule, error) {
+	r := &Rule{Include: include, Topic: topic, Expr: strings.TrimSpace(expr)}
+	if r.Expr == "" {
+		return nil, fmt.Errorf("empty rule")
+	}
+	for _, s := range splitClauses(r.Expr) {
+		c, err := parseClause(s)
+		if err != nil {
+			return nil, err
+		}
+		r.clauses = append(r.clauses, c)
+	}
+	return r, nil
+}
+
+// splitClauses splits expr at each && that is not in a double quoted value.
+func splitClauses(expr string) []string {
+	clauses := []string{}
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && expr[i] == '\\':
+			escaped = true
+		case expr[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(expr[i:], "&&"):
+			clauses = append(clauses, expr[start:i])
+			start = i + 2
+			i++
+		}
+	}
+	return append(clauses, expr[start:])
+}
+
+// LoadRules reads rules from a file. Each line is a rule starting with include
+// or exclude followed by the rule expression. Lines starting with # are
+// comments. A line containing a topic filter in square brackets, e.g.,
+// [origin/a/wis2/+/data/#], limits all following rules to messages with topics
+// matching the filter, until the next such line. [] resets to all messages.
+func LoadRules(fpath string) ([]*Rule, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []*Rule{}
+	topic := ""
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			topic = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		kind, expr := line, ""
+		if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+			kind, expr = line[:i], line[i:]
+		}
+		if kind != "include" && kind != "exclude" {
+			return nil, fmt.Errorf("%s:%d: expected include or exclude, got '%s'", fpath, lineno, kind)
+		}
+		r, err := ParseRule(kind == "include", topic, expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fpath, lineno, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// RuleFilter is a Filter applying include and exclude rules. A message is rejected
+// if it matches any applicable exclude rule, or if there are applicable include
+// rules and it matches none of them.
+type RuleFilter struct {
+	rules []*Rule
+}
+
+func NewRuleFilter(rules ...*Rule) *RuleFilter {
+	return &RuleFilter{rules: rules}
+}
+
+func (f *RuleFilter) Accept(msg *Message) error {
+	haveIncludes := false
+	included := false
+	for _, r := range f.rules {
+		if !r.appliesTo(msg) {
+			continue
+		}
+		if !r.Include {
+			if r.matches(msg) {
+				return fmt.Errorf("matched rule '%s'", r)
+			}
+			continue
+		}
+		haveIncludes = true
+		if !included && r.matches(msg) {
+			included = true
+		}
+	}
+	if haveIncludes && !included {
+		return fmt.Errorf("matched no include rules")
+	}
+	return nil
+}
+
+var _ Filter = (*RuleFilter)(nil)
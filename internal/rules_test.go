@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		Expr        string
+		ExpectError bool
+	}{
+		{`data_id ~ ^wis2/`, false},
+		{`filename = "a b.txt"`, false},
+		{`size > 10M && age < 1h`, false},
+		{`size >= 1024`, false},
+		{`filename = "a&&b.txt" && size > 1`, false},
+		{`data_id ~ "^(a|b)&&c" && action = update`, false},
+		{`data_id = "a\"&&" && size > 1`, false},
+		{`data_id = a && `, true},
+		{`nope = x`, true},
+		{`size ~ x`, true},
+		{`data_id < x`, true},
+		{`size > big`, true},
+		{`age > forever`, true},
+		{`data_id ~ (`, true},
+		{`data_id`, true},
+		{``, true},
+	}
+	for _, test := range tests {
+		_, err := ParseRule(true, "", test.Expr)
+		if test.ExpectError && err == nil {
+			t.Errorf("expected error for '%s'", test.Expr)
+		}
+		if !test.ExpectError && err != nil {
+			t.Errorf("expected no error for '%s', got %s", test.Expr, err)
+		}
+	}
+}
+
+func TestRuleFilter(t *testing.T) {
+	pubtime := time.Now().Add(-2 * time.Hour)
+	msg := &Message{
+		Topic: "origin/a/wis2/ca-eccc-msc/data/core/weather",
+		Payload: WISMessage{
+			PubTime:    &pubtime,
+			ID:         "1234",
+			DataID:     "wis2/ca-eccc-msc/data/core/weather/file.bufr4",
+			MetadataID: "urn:wmo:md:ca-eccc-msc:synop",
+			Size:       2048,
+			Links:      []Link{{Href: "https://host/file.bufr4", Rel: "canonical", Type: "application/bufr"}},
+		},
+	}
+
+	mustRule := func(include bool, topic, expr string) *Rule {
+		r, err := ParseRule(include, topic, expr)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", expr, err)
+		}
+		return r
+	}
+
+	tests := []struct {
+		Name   string
+		Rules  []*Rule
+		Accept bool
+	}{
+		{"no rules", nil, true},
+		{"include match", []*Rule{mustRule(true, "", `filename ~ \.bufr4$`)}, true},
+		{"include no match", []*Rule{mustRule(true, "", `media_type = application/grib2`)}, false},
+		{"any include", []*Rule{mustRule(true, "", `centre_id = xx`), mustRule(true, "", `centre_id = ca-eccc-msc`)}, true},
+		{"exclude match", []*Rule{mustRule(false, "", `size > 1K && age > 1h`)}, false},
+		{"exclude partial match", []*Rule{mustRule(false, "", `size > 1K && age > 3h`)}, true},
+		{"exclude wins", []*Rule{mustRule(true, "", `id = 1234`), mustRule(false, "", `metadata_id ~ synop`)}, false},
+		{"topic scoped", []*Rule{mustRule(false, "cache/#", `id = 1234`)}, true},
+		{"topic scoped match", []*Rule{mustRule(false, "origin/a/wis2/+/data/#", `id = 1234`)}, false},
+		{"not equal", []*Rule{mustRule(true, "", `action != delete && data_id !~ ^cache`)}, true},
+		{"quoted &&", []*Rule{mustRule(true, "", `id != "1234&&x" && id = 1234`)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := NewRuleFilter(test.Rules...).Accept(msg)
+			if test.Accept && err != nil {
+				t.Errorf("expected accept, got %s", err)
+			}
+			if !test.Accept && err == nil {
+				t.Errorf("expected reject")
+			}
+		})
+	}
+
+	t.Run("missing pubtime does not match", func(t *testing.T) {
+		f := NewRuleFilter(mustRule(false, "", `age > 1s`))
+		if err := f.Accept(&Message{}); err != nil {
+			t.Errorf("expected accept, got %s", err)
+		}
+	})
+}
+
+func TestLoadRules(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "rules")
+	body := `
+# comment
+exclude size > 100M
+[origin/a/wis2/#]
+include	media_type = application/bufr
+include media_type = application/bufr
+[]
+include data_id ~ ^wis2/
+`
+	if err := os.WriteFile(fpath, []byte(body), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %s", err)
+	}
+	rules, err := LoadRules(fpath)
+	if err != nil {
+		t.Fatalf("failed to load rules: %s", err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("expected 4 rules, got %v", len(rules))
+	}
+	if rules[0].Include || rules[0].Topic != "" {
+		t.Errorf("unexpected first rule %s", rules[0])
+	}
+	if !rules[1].Include || rules[1].Topic != "origin/a/wis2/#" {
+		t.Errorf("unexpected second rule %s", rules[1])
+	}
+	if !rules[2].Include || rules[2].Expr != "media_type = application/bufr" {
+		t.Errorf("expected rule separated by a tab, got %s", rules[2])
+	}
+	if rules[3].Topic != "" {
+		t.Errorf("expected topic to be reset, got %s", rules[3])
+	}
+
+	if err := os.WriteFile(fpath, []byte("keep size > 1"), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %s", err)
+	}
+	if _, err := LoadRules(fpath); err == nil {
+		t.Errorf("expected error for invalid rule kind")
+	}
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// wnmSchema is the WNM JSON Schema, updated from the published bundled schema
+// by running go generate.
+//
+//go:generate curl -fsSL -o schemas/wis2-notification-message.json https://raw.githubusercontent.com/wmo-im/wis2-notification-message/main/schemas/wis2-notification-message-bundled.json
+//go:embed schemas/wis2-notification-message.json
+var wnmSchema string
+
+// wnmSchemaName is the name the schema is loaded as, the schema's $id takes
+// precedence if it has one.
+const wnmSchemaName = "wis2-notification-message.json"
+
+// SchemaValidator is a Filter that validates WIS2 Notification Messages against
+// the bundled WNM JSON Schema. Messages in other formats are not validated.
+//
+// In strict mode non-conforming messages are rejected, otherwise a warning is
+// logged and the message is accepted. Failures are counted by topic and centre
+// in either mode.
+type SchemaValidator struct {
+	log    *Logger
+	schema *jsonschema.Schema
+	strict bool
+
+	mu       sync.Mutex
+	byTopic  map[string]int
+	byCentre map[string]int
+}
+
+func NewSchemaValidator(strict bool, log *Logger) (*SchemaValidator, error) {
+	c := jsonschema.NewCompiler()
+	c.AssertFormat = true
+	if err := c.AddResource(wnmSchemaName, strings.NewReader(wnmSchema)); err != nil {
+		return nil, fmt.Errorf("loading schema: %w", err)
+	}
+	schema, err := c.Compile(wnmSchemaName)
+	if err != nil {
+		return nil, fmt.Errorf("compiling schema: %w", err)
+	}
+	return &SchemaValidator{
+		log:      log,
+		schema:   schema,
+		strict:   strict,
+		byTopic:  map[string]int{},
+		byCentre: map[string]int{},
+	}, nil
+}
+
+// Validate body against the WNM schema.
+func (v *SchemaValidator) Validate(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("invalid json: %w", err)
+	}
+	return v.schema.Validate(doc)
+}
+
+func (v *SchemaValidator) Accept(msg *Message) error {
+	if msg.Format != (WNMDecoder{}).Name() {
+		return nil
+	}
+	err := v.Validate(msg.Raw)
+	if err == nil {
+		return nil
+	}
+
+	centre := "<unknown>"
+	if t, err := ParseTopic(msg.Topic); err == nil {
+		centre = t.CentreID
+	}
+	v.mu.Lock()
+	v.byTopic[msg.Topic]++
+	v.byCentre[centre]++
+	v.mu.Unlock()
+
+	if verr, ok := err.(*jsonschema.ValidationError); ok {
+		err = fmt.Errorf("%s", strings.Join(validationDetails(verr), "; "))
+	}
+	if v.strict {
+		v.log.Info("rejecting non-conforming message topic='%s' id='%s': %s", msg.Topic, msg.Payload.ID, err)
+		return fmt.Errorf("does not conform to schema: %w", err)
+	}
+	v.log.Warn("non-conforming message topic='%s' id='%s': %s", msg.Topic, msg.Payload.ID, err)
+	return nil
+}
+
+// validationDetails flattens a validation error to the messages for the leaf
+// causes.
+func validationDetails(err *jsonschema.ValidationError) []string {
+	if len(err.Causes) == 0 {
+		loc := err.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		return []string{loc + ": " + err.Message}
+	}
+	details := []string{}
+	for _, c := range err.Causes {
+		details = append(details, validationDetails(c)...)
+	}
+	return details
+}
+
+// Failures returns copies of the validation failure counts by topic and by
+// centre-id. Messages with topics that are not WIS2 topics are counted under
+// the centre <unknown>.
+func (v *SchemaValidator) Failures() (byTopic, byCentre map[string]int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	byTopic = make(map[string]int, len(v.byTopic))
+	for k, n := range v.byTopic {
+		byTopic[k] = n
+	}
+	byCentre = make(map[string]int, len(v.byCentre))
+	for k, n := range v.byCentre {
+		byCentre[k] = n
+	}
+	return byTopic, byCentre
+}
+
+// Report logs the validation failure counts, if any.
+func (v *SchemaValidator) Report() {
+	byTopic, byCentre := v.Failures()
+	if len(byTopic) == 0 {
+		return
+	}
+	for _, counts := range []struct {
+		name   string
+		counts map[string]int
+	}{{"centre", byCentre}, {"topic", byTopic}} {
+		keys := make([]string, 0, len(counts.counts))
+		for k := range counts.counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v.log.Info("validation failures %s='%s' count=%d", counts.name, k, counts.counts[k])
+		}
+	}
+}
+
+var _ Filter = (*SchemaValidator)(nil)
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+const fixtureWNM = `{
+	"id": "31e9d66a-cd83-4174-9429-b932f1abe1be",
+	"conformsTo": ["http://wis.wmo.int/spec/wnm/1/conf/core"],
+	"type": "Feature",
+	"geometry": {"type": "Point", "coordinates": [6.146, 46.223]},
+	"properties": {
+		"data_id": "wis2/ca-eccc-msc/data/core/weather/surface-based-observations/synop/file.bufr4",
+		"pubtime": "2022-03-20T04:50:18Z",
+		"datetime": "2022-03-20T04:45:00Z",
+		"integrity": {"method": "sha512", "value": "A2KNxvks...S8qfSCw=="}
+	},
+	"links": [{"href": "https://host/path/file.bufr4", "rel": "canonical", "type": "application/bufr"}]
+}`
+
+// sampleWNM is a notification as published, with the example values from the
+// WNM specification, including a 3D point and inline content.
+const sampleWNM = `{
+	"id": "31e9d66a-cd83-4174-9429-b932f1abe1be",
+	"conformsTo": ["http://wis.wmo.int/spec/wnm/1/conf/core"],
+	"type": "Feature",
+	"geometry": {"type": "Point", "coordinates": [6.146, 46.223, 392.0]},
+	"properties": {
+		"data_id": "ca-eccc-msc:surface-weather-observations:WIGOS_0-20000-0-06700_20220320T044500",
+		"metadata_id": "urn:wmo:md:ca-eccc-msc:surface-weather-observations",
+		"pubtime": "2022-03-20T04:50:18Z",
+		"datetime": "2022-03-20T04:45:00Z",
+		"integrity": {"method": "sha512", "value": "A2KNxvks...S8qfSCw=="},
+		"content": {"encoding": "utf-8", "value": "encoded bytes from the file", "size": 457}
+	},
+	"links": [{
+		"href": "https://example.org/data/4Pubsub/92c557ef-d28e-4713-91af-2e2e7be6f8ab.bufr4",
+		"rel": "canonical",
+		"type": "application/bufr"
+	}]
+}`
+
+func TestSchemaValidator(t *testing.T) {
+	v, err := NewSchemaValidator(false, nil)
+	if err != nil {
+		t.Fatalf("failed to create validator: %s", err)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		if err := v.Validate([]byte(fixtureWNM)); err != nil {
+			t.Errorf("expected valid message, got %s", err)
+		}
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		if err := v.Validate([]byte(sampleWNM)); err != nil {
+			t.Errorf("expected sample message to be valid, got %s", err)
+		}
+	})
+
+	invalid := []struct {
+		Name, Old, New string
+	}{
+		{"missing id", `"id": "31e9d66a-cd83-4174-9429-b932f1abe1be",`, ``},
+		{"bad pubtime", `"pubtime": "2022-03-20T04:50:18Z"`, `"pubtime": "yesterday"`},
+		{"no datetime", `"datetime": "2022-03-20T04:45:00Z",`, ``},
+		{"unsupported integrity", `"method": "sha512"`, `"method": "md5"`},
+		{"no data link", `"rel": "canonical"`, `"rel": "via"`},
+		{"not a feature", `"type": "Feature"`, `"type": "FeatureCollection"`},
+	}
+	for _, test := range invalid {
+		t.Run(test.Name, func(t *testing.T) {
+			body := strings.Replace(fixtureWNM, test.Old, test.New, 1)
+			if err := v.Validate([]byte(body)); err == nil {
+				t.Errorf("expected validation error")
+			}
+		})
+	}
+
+	msg := &Message{
+		Topic:  "origin/a/wis2/ca-eccc-msc/data/core/weather",
+		Format: "wnm",
+		Raw:    []byte(strings.Replace(fixtureWNM, `"type": "Feature"`, `"type": "Blob"`, 1)),
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		if err := v.Accept(msg); err != nil {
+			t.Errorf("expected lenient mode to accept, got %s", err)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		strict, err := NewSchemaValidator(true, nil)
+		if err != nil {
+			t.Fatalf("failed to create validator: %s", err)
+		}
+		if err := strict.Accept(msg); err == nil {
+			t.Errorf("expected strict mode to reject")
+		}
+		legacy := &Message{Format: "gtstowis2", Raw: []byte(`{}`)}
+		if err := strict.Accept(legacy); err != nil {
+			t.Errorf("expected non-WNM message to be accepted, got %s", err)
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		byTopic, byCentre := v.Failures()
+		if byTopic[msg.Topic] != 1 {
+			t.Errorf("expected 1 failure for topic, got %v", byTopic)
+		}
+		if byCentre["ca-eccc-msc"] != 1 {
+			t.Errorf("expected 1 failure for centre, got %v", byCentre)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as 1.2.
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version '%s', expected one of 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// TLSOptions configures the TLS used for broker connections and downloads.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of CAs used instead of the system roots for broker
+	// connections and in addition to them for downloads
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used to verify the broker certificate. It is
+	// not used for downloads.
+	ServerName string
+	MinVersion uint16
+	// Insecure disables certificate verification
+	Insecure bool
+}
+
+// TLSProvider provides TLS configuration loaded from TLSOptions that may be
+// reloaded, e.g., when certificates are renewed. Connections made after a
+// reload use the new configuration.
+type TLSProvider struct {
+	opts TLSOptions
+
+	mu        sync.Mutex
+	cfg       *tls.Config
+	transport *http.Transport
+}
+
+// NewTLSProvider loads the certificates in opts, returning an error if they
+// cannot be loaded.
+func NewTLSProvider(opts TLSOptions) (*TLSProvider, error) {
+	p := &TLSProvider{opts: opts}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload the certificates. The existing configuration is kept on error.
+func (p *TLSProvider) Reload() error {
+	cfg := &tls.Config{
+		MinVersion:         p.opts.MinVersion,
+		InsecureSkipVerify: p.opts.Insecure,
+	}
+	// Downloads may be from any server, so they also use the system roots
+	var downloadRoots *x509.CertPool
+	if p.opts.CAFile != "" {
+		pem, err := os.ReadFile(p.opts.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", p.opts.CAFile)
+		}
+		cfg.RootCAs = pool
+		downloadRoots, err = x509.SystemCertPool()
+		if err != nil {
+			downloadRoots = x509.NewCertPool()
+		}
+		downloadRoots.AppendCertsFromPEM(pem)
+	}
+	if p.opts.CertFile != "" || p.opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.opts.CertFile, p.opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg.Clone()
+	transport.TLSClientConfig.RootCAs = downloadRoots
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+	p.cfg = cfg
+	p.transport = transport
+	return nil
+}
+
+// Config returns the current TLS configuration for broker connections.
+func (p *TLSProvider) Config() *tls.Config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cfg := p.cfg.Clone()
+	cfg.ServerName = p.opts.ServerName
+	return cfg
+}
+
+// Transport returns an HTTP transport using the current TLS configuration.
+func (p *TLSProvider) Transport() http.RoundTripper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.transport
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		Version     string
+		Expected    uint16
+		ExpectError bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.4", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		v, err := ParseTLSVersion(test.Version)
+		if (err != nil) != test.ExpectError {
+			t.Errorf("%s: expected error=%v, got %v", test.Version, test.ExpectError, err)
+		}
+		if v != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Version, test.Expected, v)
+		}
+	}
+}
+
+func TestTLSProvider(t *testing.T) {
+	var servedCert bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servedCert = len(r.TLS.PeerCertificates) > 0
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	// The test server certificate and key are used as both the CA bundle and the
+	// client certificate
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	cert := srv.TLS.Certificates[0]
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(caFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS.ClientAuth = tls.RequestClientCert
+
+	t.Run("verify with CA", func(t *testing.T) {
+		p, err := NewTLSProvider(TLSOptions{CAFile: caFile, CertFile: caFile, KeyFile: keyFile, ServerName: "broker"})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if p.Config().ServerName != "broker" {
+			t.Errorf("expected server name broker, got %s", p.Config().ServerName)
+		}
+		buf := &bytes.Buffer{}
+		if err := NewFetcherFactory(p)(srv.URL).Fetch(srv.URL, buf); err != nil {
+			t.Fatalf("expected fetch to succeed, got %s", err)
+		}
+		if buf.String() != "data" {
+			t.Errorf("unexpected data %s", buf)
+		}
+		if !servedCert {
+			t.Errorf("expected client certificate to be sent")
+		}
+	})
+
+	t.Run("CA with system roots for downloads", func(t *testing.T) {
+		sys, err := x509.SystemCertPool()
+		if err != nil || len(sys.Subjects()) == 0 {
+			t.Skip("no system roots")
+		}
+		p, err := NewTLSProvider(TLSOptions{CAFile: caFile})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if n := len(p.Config().RootCAs.Subjects()); n != 1 {
+			t.Errorf("expected only the CA bundle for the broker, got %d roots", n)
+		}
+		roots := p.Transport().(*http.Transport).TLSClientConfig.RootCAs
+		if n := len(roots.Subjects()); n != len(sys.Subjects())+1 {
+			t.Errorf("expected system roots and CA bundle for downloads, got %d roots", n)
+		}
+	})
+
+	t.Run("system roots", func(t *testing.T) {
+		p, err := NewTLSProvider(TLSOptions{})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if err := NewFetcherFactory(p)(srv.URL).Fetch(srv.URL, &bytes.Buffer{}); err == nil {
+			t.Errorf("expected verification failure")
+		}
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		p, err := NewTLSProvider(TLSOptions{Insecure: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if err := NewFetcherFactory(p)(srv.URL).Fetch(srv.URL, &bytes.Buffer{}); err != nil {
+			t.Errorf("expected insecure fetch to succeed, got %s", err)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		p, err := NewTLSProvider(TLSOptions{CAFile: caFile})
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		bad := filepath.Join(dir, "bad.pem")
+		os.WriteFile(bad, []byte("nope"), 0o644)
+		p.opts.CAFile = bad
+		if err := p.Reload(); err == nil {
+			t.Errorf("expected reload of invalid bundle to fail")
+		}
+		if p.Config().RootCAs == nil {
+			t.Errorf("expected previous config to be kept")
+		}
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		if _, err := NewTLSProvider(TLSOptions{CAFile: filepath.Join(dir, "missing")}); err == nil {
+			t.Errorf("expected error for missing CA bundle")
+		}
+		if _, err := NewTLSProvider(TLSOptions{CertFile: caFile}); err == nil {
+			t.Errorf("expected error for missing key")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Topic is a topic parsed according to the WIS2 Topic Hierarchy, e.g.,
+// origin/a/wis2/ca-eccc-msc/data/core/weather/surface-based-observations/synop.
+type Topic struct {
+	Channel          string // origin or cache
+	Version          string // a
+	System           string // wis2
+	CentreID         string
+	NotificationType string // data or metadata
+	DataPolicy       string // core or recommended
+	Discipline       string // earth-system-discipline
+	// Subtopics are any levels following the discipline.
+	Subtopics []string
+}
+
+// Subtopic returns the levels following the discipline joined by /.
+func (t *Topic) Subtopic() string {
+	return strings.Join(t.Subtopics, "/")
+}
+
+func (t *Topic) String() string {
+	levels := []string{t.Channel, t.Version, t.System, t.CentreID, t.NotificationType}
+	for _, l := range []string{t.DataPolicy, t.Discipline} {
+		if l == "" {
+			break
+		}
+		levels = append(levels, l)
+	}
+	return strings.Join(append(levels, t.Subtopics...), "/")
+}
+
+// Env returns the topic fields as environment variables in the form WIS2_<FIELD>=<value>.
+func (t *Topic) Env() []string {
+	return []string{
+		"WIS2_CHANNEL=" + t.Channel,
+		"WIS2_CENTRE_ID=" + t.CentreID,
+		"WIS2_NOTIFICATION_TYPE=" + t.NotificationType,
+		"WIS2_DATA_POLICY=" + t.DataPolicy,
+		"WIS2_DISCIPLINE=" + t.Discipline,
+		"WIS2_SUBTOPIC=" + t.Subtopic(),
+	}
+}
+
+type topicLevel struct {
+	name    string
+	allowed []string
+}
+
+// topicLevels are the fixed levels of the WIS2 Topic Hierarchy. A nil allowed
+// list accepts any non-empty value.
+var topicLevels = []topicLevel{
+	{"channel", []string{"origin", "cache"}},
+	{"version", []string{"a"}},
+	{"system", []string{"wis2"}},
+	{"centre-id", nil},
+	{"notification-type", []string{"data", "metadata"}},
+	{"data-policy", []string{"core", "recommended"}},
+	{"earth-system-discipline", []string{
+		"weather", "climate", "hydrology", "atmospheric-composition", "cryosphere", "ocean",
+		"space-weather",
+	}},
+}
+
+func checkTopicLevel(idx int, val string) error {
+	lvl := topicLevels[idx]
+	if val == "" {
+		return fmt.Errorf("level %d %s is empty", idx+1, lvl.name)
+	}
+	if lvl.allowed == nil {
+		return nil
+	}
+	for _, a := range lvl.allowed {
+		if val == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("level %d %s is '%s', expected one of %s", idx+1, lvl.name, val, strings.Join(lvl.allowed, ", "))
+}
+
+// ParseTopic parses a WIS2 Topic Hierarchy topic. Topics must include at least
+// the notification type level. Data topics must include the data policy and
+// earth-system-discipline.
+func ParseTopic(topic string) (*Topic, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 5 {
+		return nil, fmt.Errorf("invalid WIS2 topic '%s': expected at least 5 levels, got %d", topic, len(levels))
+	}
+	for i, l := range levels {
+		if l == "+" || l == "#" {
+			return nil, fmt.Errorf("invalid WIS2 topic '%s': wildcards are not allowed", topic)
+		}
+		if i < len(topicLevels) {
+			if err := checkTopicLevel(i, l); err != nil {
+				return nil, fmt.Errorf("invalid WIS2 topic '%s': %w", topic, err)
+			}
+		}
+	}
+	t := &Topic{
+		Channel:          levels[0],
+		Version:          levels[1],
+		System:           levels[2],
+		CentreID:         levels[3],
+		NotificationType: levels[4],
+	}
+	if t.NotificationType == "data" && len(levels) < 7 {
+		return nil, fmt.Errorf("invalid WIS2 topic '%s': data topics require data-policy and earth-system-discipline levels", topic)
+	}
+	if len(levels) > 5 {
+		t.DataPolicy = levels[5]
+	}
+	if len(levels) > 6 {
+		t.Discipline = levels[6]
+	}
+	if len(levels) > 7 {
+		t.Subtopics = levels[7:]
+	}
+	return t, nil
+}
+
+// ValidateTopicFilter checks that an MQTT topic filter, which may include + and #
+// wildcards, can match topics in the WIS2 Topic Hierarchy.
+func ValidateTopicFilter(filter string) error {
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		switch {
+		case l == "#":
+			if i != len(levels)-1 {
+				return fmt.Errorf("invalid topic '%s': # must be the last level", filter)
+			}
+			return nil
+		case l == "+":
+			continue
+		case strings.ContainsAny(l, "+#"):
+			return fmt.Errorf("invalid topic '%s': wildcards must occupy an entire level", filter)
+		}
+		if i < len(topicLevels) {
+			if err := checkTopicLevel(i, l); err != nil {
+				return fmt.Errorf("invalid topic '%s': %w", filter, err)
+			}
+		}
+	}
+	if len(levels) < 5 {
+		return fmt.Errorf("invalid topic '%s': expected at least 5 levels, or a # wildcard, got %d", filter, len(levels))
+	}
+	return nil
+}
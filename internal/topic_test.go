@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestParseTopic(t *testing.T) {
+	topic, err := ParseTopic("origin/a/wis2/ca-eccc-msc/data/core/weather/surface-based-observations/synop")
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	expected := Topic{
+		Channel:          "origin",
+		Version:          "a",
+		System:           "wis2",
+		CentreID:         "ca-eccc-msc",
+		NotificationType: "data",
+		DataPolicy:       "core",
+		Discipline:       "weather",
+		Subtopics:        []string{"surface-based-observations", "synop"},
+	}
+	if topic.String() != expected.String() || topic.CentreID != expected.CentreID ||
+		topic.Discipline != expected.Discipline || topic.Subtopic() != "surface-based-observations/synop" {
+		t.Errorf("expected %+v, got %+v", expected, topic)
+	}
+
+	tests := []struct {
+		Topic  string
+		ErrPat string
+	}{
+		{"cache/a/wis2/ca-eccc-msc/metadata", ""},
+		{"cache/a/wis2/ca-eccc-msc/data/recommended/ocean", ""},
+		{"origin/a/wis2", "at least 5 levels"},
+		{"local/a/wis2/ca-eccc-msc/data/core/weather", "channel is 'local'"},
+		{"origin/a/wis2//data/core/weather", "centre-id is empty"},
+		{"origin/a/wis2/ca-eccc-msc/data", "data topics require"},
+		{"origin/a/wis2/ca-eccc-msc/data/core/weathr", "earth-system-discipline is 'weathr'"},
+		{"origin/a/wis2/+/data/core/weather", "wildcards"},
+	}
+	for _, test := range tests {
+		_, err := ParseTopic(test.Topic)
+		if test.ErrPat == "" && err != nil {
+			t.Errorf("did not expect error for %s, got %s", test.Topic, err)
+		}
+		if test.ErrPat != "" && (err == nil || !regexp.MustCompile(test.ErrPat).MatchString(err.Error())) {
+			t.Errorf("expected error matching %s for %s, got %v", test.ErrPat, test.Topic, err)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		Filter string
+		ErrPat string
+	}{
+		{"origin/a/wis2/#", ""},
+		{"#", ""},
+		{"+/a/wis2/+/data/core/weather/#", ""},
+		{"origin/a/wis2/ca-eccc-msc/metadata", ""},
+		{"origin/a/wis2/#/data", "must be the last level"},
+		{"origin/a/wis2/ca+/data", "entire level"},
+		{"origin/b/wis2/#", "version is 'b'"},
+		{"origin/a/wis2/+", "at least 5 levels"},
+		{"xpublic/v03/#", "channel is 'xpublic'"},
+	}
+	for _, test := range tests {
+		err := ValidateTopicFilter(test.Filter)
+		if test.ErrPat == "" && err != nil {
+			t.Errorf("did not expect error for %s, got %s", test.Filter, err)
+		}
+		if test.ErrPat != "" && (err == nil || !regexp.MustCompile(test.ErrPat).MatchString(err.Error())) {
+			t.Errorf("expected error matching %s for %s, got %v", test.ErrPat, test.Filter, err)
+		}
+	}
+}
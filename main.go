@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bmflynn/wis2/internal"
 	"github.com/spf13/pflag"
@@ -21,22 +25,150 @@ func init() {
 	flags.Bool("verbose", false, "Verbose output")
 	flags.Bool("version", false, "Show version and exit")
 
-	flags.StringP("broker", "b", os.Getenv("WIS2_BROKER"),
-		"MQTT broker URL as either ssl://<host>[:<port>] for MQTT over TLS or tcp://<host>[:<port>] "+
-			"for MQTT without TLS. If the port is not specified the MQTT standard port numbers 8883 "+
-			"and 1883 will be used.",
+	var brokers []string
+	if s := os.Getenv("WIS2_BROKER"); s != "" {
+		brokers = strings.Split(s, ",")
+	}
+	flags.StringSliceP("broker", "b", brokers,
+		"MQTT broker URL as either ssl://<host>[:<port>] for MQTT over TLS, tcp://<host>[:<port>] "+
+			"for MQTT without TLS, or wss://<host>[:<port>][/<path>] or ws://<host>[:<port>][/<path>] "+
+			"for MQTT over WebSockets with and without TLS. If the port is not specified the standard "+
+			"port numbers 8883, 1883, 443 and 80 will be used. May be specified multiple times or as "+
+			"CSV to receive from multiple brokers, e.g., several WIS2 Global Brokers, in which case messages received "+
+			"from more than one broker are only ingested once. AMQP 0-9-1 brokers are supported using "+
+			"amqps://<host>[:<port>][/<vhost>] or amqp://<host>[:<port>][/<vhost>]. Notifications "+
+			"may also be replayed from a file of JSON lines or a directory of .json files using "+
+			"file://<path>[?topic=<topic>], where topic is used for notifications without a topic, "+
+			"received using HTTP POST by listening on http://<host>:<port>[/<path>], or received "+
+			"from notification files written to a directory using dir://<path>[?topic=<topic>].",
 	)
+	flags.Bool("broker-failover", false,
+		"When multiple brokers are specified, only ingest messages from the first broker and use "+
+			"the others, in order, as hot standbys while it is disconnected. Messages standbys "+
+			"received in the minute before failing over are also used.")
+	flags.String("tls-ca", "",
+		"PEM bundle of CA certificates used to verify the broker instead of the system roots. "+
+			"Download servers are verified using both.")
+	flags.String("tls-cert", "", "PEM client certificate for mutual TLS. Requires --tls-key.")
+	flags.String("tls-key", "", "PEM client certificate key for mutual TLS.")
+	flags.String("tls-server-name", "",
+		"Server name used to verify the broker certificate, if different from the broker host.")
+	flags.String("tls-min-version", "1.2", "Minimum TLS version, one of 1.0, 1.1, 1.2 or 1.3.")
+	flags.Bool("tls-insecure", false,
+		"Do not verify broker and download server certificates. This is insecure and should only "+
+			"be used for testing.")
+	flags.StringArray("ws-header", nil,
+		"HTTP header sent when connecting to ws:// and wss:// brokers as '<name>: <value>'. May be "+
+			"specified multiple times.")
+	flags.String("proxy", "",
+		"HTTP proxy URL used to connect to ws:// and wss:// brokers. By default the proxy is "+
+			"determined by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.")
+	flags.String("share-group", "",
+		"Subscribe using MQTT shared subscriptions in this group so messages are split between all "+
+			"instances using the same group. Instances should share --datadir so files are only "+
+			"stored once. Deduplication is not coordinated between instances, see --dedup-db.")
+	flags.String("protocol", "auto",
+		"MQTT protocol version, one of 5, 3.1.1 or auto. With auto, MQTT v5 is used unless the broker "+
+			"does not support it.")
+	flags.String("client-id", "",
+		"MQTT client id. By default an id is generated and saved to .client-id in --datadir, or "+
+			".client-id-<hostname> with --share-group, so the broker session is resumed after a restart.")
+	flags.Duration("session-expiry", 24*time.Hour,
+		"How long the broker keeps the session, and messages for it, after disconnecting. Only used "+
+			"with MQTT v5; 0 ends the session on disconnect.")
+	flags.Bool("insecure-webhook", false,
+		"Accept requests to http:// brokers without authentication if neither WIS2_WEBHOOK_TOKEN "+
+			"nor WIS2_WEBHOOK_SECRET is set. This is insecure and should only be used for testing.")
+	flags.Int64("webhook-max-size", 1024*1024, "Maximum size in bytes of a notification request to an http:// broker.")
+	flags.Duration("webhook-ack-timeout", 30*time.Second,
+		"How long a request to an http:// broker waits for its notifications to be ingested before "+
+			"responding that they were accepted.")
+	flags.Duration("dir-poll-interval", time.Second,
+		"How often dir:// directories are scanned if they cannot be watched, and how long a "+
+			"notification file must be unmodified before it is received.")
+	flags.Bool("dir-polling", false,
+		"Scan dir:// directories rather than watching them, e.g., for network filesystems.")
+	flags.String("record", "",
+		"Directory to record every notification received to, before it is decoded, as gzip "+
+			"compressed JSON lines. Recordings can be replayed using a file:// broker URL.")
+	flags.Int64("record-max-size", 100, "Size in MB after which a new recording file is started.")
+	flags.Duration("record-max-age", time.Hour, "Duration after which a new recording file is started.")
+	flags.Float64("replay-speed", 0,
+		"Replay file:// notifications with the time between them as received divided by this "+
+			"factor, e.g., 1 for the original spacing. By default they are replayed without delay.")
+	flags.String("amqp-exchange", "xpublic", "AMQP exchange to bind the queue to.")
+	flags.String("amqp-queue", "",
+		"Durable AMQP queue to consume from, so messages are not lost while disconnected. Defaults "+
+			"to the client id.")
+	flags.StringSlice("amqp-binding-key", nil,
+		"AMQP binding key. May be specified multiple times or as CSV. Defaults to the topics with / "+
+			"replaced by . and + by *.")
 	flags.StringSliceP("topic", "t", nil, "Topic to subscribe to. May be specified multiple times or as CSV.")
+	flags.Bool("skip-topic-validation", false,
+		"Do not validate topics against the WIS2 Topic Hierarchy, e.g., to subscribe to legacy topics.")
 	flags.Bool("ignore-topic-errors", false,
 		"Ignore errors that occur when subscribing to topics. By default a subscription failure for "+
 			"any topic is fatal.")
 
+	flags.StringSlice("decoder", nil,
+		"Decoder to use for messages matching a topic filter as <filter>=<decoder>, e.g., "+
+			"origin/a/wis2/#=wnm. May be specified multiple times or as CSV. Available decoders are "+
+			"wnm and gtstowis2. By default the decoder is selected by the message content type, "+
+			"if available, or by the message content.")
+
+	flags.Bool("strict", false,
+		"Reject WIS2 Notification Messages that do not conform to the WNM JSON Schema. By default "+
+			"non-conforming messages are logged as warnings and ingested.")
+
+	flags.Float64Slice("bbox", nil,
+		"Only ingest data with a geometry intersecting the bounding box <minx>,<miny>,<maxx>,<maxy> "+
+			"in decimal degrees. A bounding box crossing the antimeridian has minx greater than maxx.")
+	flags.String("region", "",
+		"Only ingest data with a geometry intersecting the polygons in this GeoJSON file, which may "+
+			"contain a geometry, feature or feature collection.")
+	flags.Bool("region-accept-null", true,
+		"Ingest data without a geometry when filtering using --bbox or --region.")
+
+	flags.StringArray("include", nil,
+		"Only ingest messages matching this rule expression, e.g., 'data_id ~ ^wis2/ca-eccc-msc/'. "+
+			"May be specified multiple times, in which case a message must match any one of them. "+
+			"See --rules for the expression syntax.")
+	flags.StringArray("exclude", nil,
+		"Do not ingest messages matching this rule expression, e.g., 'size > 100M'. May be specified "+
+			"multiple times.")
+	flags.String("rules", "",
+		"File containing include and exclude rules, one per line as include|exclude <expr>. An "+
+			"expression is one or more <field> <op> <value> clauses joined by &&. Fields are topic, "+
+			"id, data_id, metadata_id, filename, media_type, action, size, age and the WIS2 topic levels "+
+			"channel, centre_id, notification_type, data_policy, discipline and subtopic. Operators "+
+			"are =, !=, ~ (regex), !~, <, <=, > and >=. A [<topic filter>] line limits the following "+
+			"rules to matching topics.")
+
 	flags.IntP("workers", "w", 4, "Maximum number of files to download concurrently.")
 	flags.StringP("datadir", "d", "data", "Directory to store data")
+	flags.Duration("dedup-ttl", 24*time.Hour,
+		"How long to remember messages, by notification id and data_id, to drop duplicates, e.g., the "+
+			"same notification received on origin and cache topics. Use 0 to disable deduplication.")
+	flags.String("dedup-db", "",
+		"Database used to remember messages for deduplication. Defaults to .seen.db in --datadir, or "+
+			".seen-<hostname>.db with --share-group since the database cannot be shared by instances. "+
+			"Deduplication is therefore per instance, so the same notification on origin and cache "+
+			"topics may be received by different instances in a group; the shared --datadir ensures "+
+			"the file is only stored once.")
+	flags.Bool("sidecar", false,
+		"Write the notification metadata for each stored file to <file>"+internal.SidecarSuffix+".")
+	flags.String("layout", "",
+		"Go text/template for the directory, relative to --datadir, files are stored in. The template is "+
+			"executed with the WIS2 topic fields Channel, CentreID, NotificationType, DataPolicy, "+
+			"Discipline and Subtopic, e.g., '{{.CentreID}}/{{.Discipline}}/{{.Subtopic}}'. By default "+
+			"files are stored in directories matching the topic.")
 
 	flags.String("command", "",
 		"A script or command to execute for every file successfully ingested file. The command must take "+
-			"the topic and the local file path as arguments. Command failures are logged, but not fatal. "+
+			"the topic, the local file path and the action, one of new, update or delete, as arguments. "+
+			"WIS2 topic fields are available in the WIS2_CHANNEL, WIS2_CENTRE_ID, WIS2_NOTIFICATION_TYPE, "+
+			"WIS2_DATA_POLICY, WIS2_DISCIPLINE and WIS2_SUBTOPIC environment variables. "+
+			"Command failures are logged, but not fatal. "+
 			"The command should be very simple and execute quickly to avoid clogging up message "+
 			"consumption. Commands are run sequentially after files are downloaded.")
 
@@ -52,9 +184,17 @@ func chkflag(err error) {
 func usage() {
 	fmt.Fprintf(os.Stderr, `Services for downloading products diseminated WMO WIS2. 
 	
-Usage: %s [flags] --broker=<broker> --topic=<topic> [--topic=...]
+Usage: %s [flags] --broker=<broker> [--broker=...] --topic=<topic> [--topic=...]
+
+Broker credentials are specified using the WIS2_(USER|PASSWD) environment variables, or
+WIS_(USER|PASSWD) which are used if the WIS2_ variables are not set.
 
-Broker credentials are specified using the WIS2_(USER|PASSWD) environment variables.
+Requests to http:// brokers are authenticated using a bearer token and/or a hex encoded
+HMAC-SHA256 signature of the body in the X-Hub-Signature-256 header as sha256=<signature>
+using the WIS2_WEBHOOK_TOKEN and WIS2_WEBHOOK_SECRET environment variables. At least one
+is required unless --insecure-webhook is set.
+
+TLS certificates are reloaded on SIGHUP.
 
 Data will be downloaded to the directory provided by --datadir in directories matching
 the topic. 
@@ -82,22 +222,197 @@ func Execute() error {
     return nil
 	}
 
-	brokerURL, err := flags.GetString("broker")
+	brokerURLs, err := flags.GetStringSlice("broker")
 	chkflag(err)
-	if brokerURL == "" {
+	if len(brokerURLs) == 0 {
 		return fmt.Errorf("--broker must be specified")
 	}
+	failover, err := flags.GetBool("broker-failover")
+	chkflag(err)
+	wsHeaders, err := flags.GetStringArray("ws-header")
+	chkflag(err)
+	header := http.Header{}
+	for _, h := range wsHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid --ws-header '%s', expected '<name>: <value>'", h)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	proxy, err := flags.GetString("proxy")
+	chkflag(err)
+	var proxyURL *url.URL
+	if proxy != "" {
+		proxyURL, err = url.Parse(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid --proxy: %w", err)
+		}
+	}
+	shareGroup, err := flags.GetString("share-group")
+	chkflag(err)
+	if shareGroup != "" {
+		if err := internal.ValidateShareGroup(shareGroup); err != nil {
+			return fmt.Errorf("invalid --share-group: %w", err)
+		}
+	}
+	clientID, err := flags.GetString("client-id")
+	chkflag(err)
+	sessionExpiry, err := flags.GetDuration("session-expiry")
+	chkflag(err)
+	insecureWebhook, err := flags.GetBool("insecure-webhook")
+	chkflag(err)
+	webhookMaxSize, err := flags.GetInt64("webhook-max-size")
+	chkflag(err)
+	webhookAckTimeout, err := flags.GetDuration("webhook-ack-timeout")
+	chkflag(err)
+	dirPollInterval, err := flags.GetDuration("dir-poll-interval")
+	chkflag(err)
+	dirPolling, err := flags.GetBool("dir-polling")
+	chkflag(err)
+	recordDir, err := flags.GetString("record")
+	chkflag(err)
+	recordMaxSize, err := flags.GetInt64("record-max-size")
+	chkflag(err)
+	recordMaxAge, err := flags.GetDuration("record-max-age")
+	chkflag(err)
+	replaySpeed, err := flags.GetFloat64("replay-speed")
+	chkflag(err)
+	amqpExchange, err := flags.GetString("amqp-exchange")
+	chkflag(err)
+	amqpQueue, err := flags.GetString("amqp-queue")
+	chkflag(err)
+	amqpBindingKeys, err := flags.GetStringSlice("amqp-binding-key")
+	chkflag(err)
+	protocol, err := flags.GetString("protocol")
+	chkflag(err)
+	var protocolVersion byte
+	switch protocol {
+	case "auto":
+		protocolVersion = internal.MQTTAuto
+	case "3.1.1":
+		protocolVersion = internal.MQTTv311
+	case "5":
+		protocolVersion = internal.MQTTv5
+	default:
+		return fmt.Errorf("invalid --protocol '%s', expected one of 5, 3.1.1 or auto", protocol)
+	}
+	tlsOpts := internal.TLSOptions{}
+	tlsOpts.CAFile, err = flags.GetString("tls-ca")
+	chkflag(err)
+	tlsOpts.CertFile, err = flags.GetString("tls-cert")
+	chkflag(err)
+	tlsOpts.KeyFile, err = flags.GetString("tls-key")
+	chkflag(err)
+	tlsOpts.ServerName, err = flags.GetString("tls-server-name")
+	chkflag(err)
+	tlsOpts.Insecure, err = flags.GetBool("tls-insecure")
+	chkflag(err)
+	tlsMinVersion, err := flags.GetString("tls-min-version")
+	chkflag(err)
+	tlsOpts.MinVersion, err = internal.ParseTLSVersion(tlsMinVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --tls-min-version: %w", err)
+	}
+	if (tlsOpts.CertFile == "") != (tlsOpts.KeyFile == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be specified together")
+	}
+	tlsProvider, err := internal.NewTLSProvider(tlsOpts)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	defaultFetcherFactory = internal.NewFetcherFactory(tlsProvider)
 	topics, err := flags.GetStringSlice("topic")
 	chkflag(err)
 	if len(topics) == 0 {
 		return fmt.Errorf("no topics specified")
 	}
+	skipTopicValidation, err := flags.GetBool("skip-topic-validation")
+	chkflag(err)
+	if !skipTopicValidation {
+		for _, topic := range topics {
+			if err := internal.ValidateTopicFilter(topic); err != nil {
+				return fmt.Errorf("%w; use --skip-topic-validation for non-WIS2 topics", err)
+			}
+		}
+	}
 	ignoreTopicErrs, err := flags.GetBool("ignore-topic-errors")
 	chkflag(err)
-	dataDir, err := flags.GetString("datadir")
+	decoderAssignments, err := flags.GetStringSlice("decoder")
 	chkflag(err)
+	for _, s := range decoderAssignments {
+		filter, name, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("invalid --decoder '%s', expected <filter>=<decoder>", s)
+		}
+		if err := internal.DefaultDecoders.Assign(filter, name); err != nil {
+			return fmt.Errorf("invalid --decoder '%s': %w", s, err)
+		}
+	}
 	verbose, err := flags.GetBool("verbose")
 	chkflag(err)
+	strict, err := flags.GetBool("strict")
+	chkflag(err)
+	validator, err := internal.NewSchemaValidator(strict, internal.NewLogger(verbose))
+	if err != nil {
+		return fmt.Errorf("creating schema validator: %w", err)
+	}
+	filters := []internal.Filter{validator}
+	bbox, err := flags.GetFloat64Slice("bbox")
+	chkflag(err)
+	region, err := flags.GetString("region")
+	chkflag(err)
+	acceptNull, err := flags.GetBool("region-accept-null")
+	chkflag(err)
+	if len(bbox) > 0 {
+		if len(bbox) != 4 {
+			return fmt.Errorf("--bbox requires 4 values")
+		}
+		f, err := internal.NewBBoxFilter(bbox[0], bbox[1], bbox[2], bbox[3])
+		if err != nil {
+			return err
+		}
+		filters = append(filters, f.AcceptNull(acceptNull))
+	}
+	if region != "" {
+		f, err := internal.LoadGeoFilter(region)
+		if err != nil {
+			return fmt.Errorf("invalid --region: %w", err)
+		}
+		filters = append(filters, f.AcceptNull(acceptNull))
+	}
+	rules := []*internal.Rule{}
+	rulesFile, err := flags.GetString("rules")
+	chkflag(err)
+	if rulesFile != "" {
+		rules, err = internal.LoadRules(rulesFile)
+		if err != nil {
+			return fmt.Errorf("invalid --rules: %w", err)
+		}
+	}
+	for _, kind := range []string{"include", "exclude"} {
+		exprs, err := flags.GetStringArray(kind)
+		chkflag(err)
+		for _, expr := range exprs {
+			r, err := internal.ParseRule(kind == "include", "", expr)
+			if err != nil {
+				return fmt.Errorf("invalid --%s '%s': %w", kind, expr, err)
+			}
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) > 0 {
+		filters = append(filters, internal.NewRuleFilter(rules...))
+	}
+	dataDir, err := flags.GetString("datadir")
+	chkflag(err)
+	layout, err := flags.GetString("layout")
+	chkflag(err)
+	sidecar, err := flags.GetBool("sidecar")
+	chkflag(err)
+	dedupTTL, err := flags.GetDuration("dedup-ttl")
+	chkflag(err)
+	dedupDB, err := flags.GetString("dedup-db")
+	chkflag(err)
 	command, err := flags.GetString("command")
 	chkflag(err)
 	workers, err := flags.GetInt("workers")
@@ -110,26 +425,217 @@ func Execute() error {
 		log.Printf("signal '%s'", <-ch)
 		cancel()
 	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := tlsProvider.Reload(); err != nil {
+				log.Printf("failed to reload TLS certificates: %s", err)
+				continue
+			}
+			log.Printf("reloaded TLS certificates")
+		}
+	}()
 
-	// The new broker will be cleanly disconnected iff the context is canceled.
-	receiver, err := internal.NewMQTTReceiver(
-		ctx, brokerURL, topics,
-		internal.WithIgnoreTopicErrors(ignoreTopicErrs),
-		internal.WithEnvCredentials("WIS"),
-	)
-	if err != nil {
-		log.Fatalf("failed to create message receiver: %s", err)
+	if clientID == "" {
+		fpath := filepath.Join(dataDir, ".client-id")
+		if shareGroup != "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.Fatalf("failed to get hostname: %s", err)
+			}
+			fpath = filepath.Join(dataDir, ".client-id-"+hostname)
+		}
+		clientID, err = internal.LoadClientID(fpath)
+		if err != nil {
+			log.Fatalf("failed to load client id: %s", err)
+		}
+	}
+
+	// The new brokers will be cleanly disconnected iff the context is canceled.
+	receivers := []internal.Receiver{}
+	var recorder *internal.Recorder
+	if recordDir != "" {
+		recorder, err = internal.NewRecorder(recordDir,
+			internal.WithRecordMaxSize(recordMaxSize*1024*1024), internal.WithRecordMaxAge(recordMaxAge))
+		if err != nil {
+			log.Fatalf("failed to create recorder: %s", err)
+		}
+		defer recorder.Close()
+	}
+
+	if amqpQueue == "" {
+		amqpQueue = clientID
+	}
+	dirRoots := []string{}
+	for _, brokerURL := range brokerURLs {
+		if internal.IsDirURL(brokerURL) {
+			recv, err := internal.NewDirReceiver(ctx, brokerURL, topics,
+				internal.WithDirPollInterval(dirPollInterval), internal.WithDirPolling(dirPolling))
+			if err != nil {
+				log.Fatalf("failed to create message receiver: %s", err)
+			}
+			receivers = append(receivers, recv)
+			dirRoots = append(dirRoots, recv.Path())
+			continue
+		}
+		if internal.IsFileURL(brokerURL) {
+			recv, err := internal.NewFileReceiver(ctx, brokerURL, topics, internal.WithReplaySpeed(replaySpeed))
+			if err != nil {
+				log.Fatalf("failed to create message receiver: %s", err)
+			}
+			receivers = append(receivers, recv)
+			continue
+		}
+		if internal.IsHTTPURL(brokerURL) {
+			opts := []internal.HTTPReceiverOpt{
+				internal.WithHTTPMaxBodySize(webhookMaxSize),
+				internal.WithHTTPAckTimeout(webhookAckTimeout),
+				internal.WithHTTPInsecure(insecureWebhook),
+				internal.WithHTTPSkipTopicValidation(skipTopicValidation),
+			}
+			if token := os.Getenv("WIS2_WEBHOOK_TOKEN"); token != "" {
+				opts = append(opts, internal.WithHTTPBearerToken(token))
+			}
+			if secret := os.Getenv("WIS2_WEBHOOK_SECRET"); secret != "" {
+				opts = append(opts, internal.WithHTTPHMACSecret([]byte(secret)))
+			}
+			if recorder != nil {
+				opts = append(opts, internal.WithHTTPRecorder(recorder))
+			}
+			recv, err := internal.NewHTTPReceiver(ctx, brokerURL, topics, opts...)
+			if err != nil {
+				log.Fatalf("failed to create message receiver: %s", err)
+			}
+			receivers = append(receivers, recv)
+			continue
+		}
+		if internal.IsAMQPURL(brokerURL) {
+			opts := []internal.AMQPReceiverOpt{
+				// WIS_ is supported for existing deployments, WIS2_ takes precedence
+				internal.WithAMQPEnvCredentials("WIS"),
+				internal.WithAMQPEnvCredentials("WIS2"),
+				internal.WithAMQPTLSProvider(tlsProvider),
+				internal.WithAMQPExchange(amqpExchange),
+				internal.WithAMQPQueue(amqpQueue),
+				internal.WithAMQPPrefetch(workers),
+				internal.WithAMQPConnectRetry(len(brokerURLs) > 1),
+			}
+			if len(amqpBindingKeys) > 0 {
+				opts = append(opts, internal.WithAMQPBindingKeys(amqpBindingKeys...))
+			}
+			if recorder != nil {
+				opts = append(opts, internal.WithAMQPRecorder(recorder))
+			}
+			recv, err := internal.NewAMQPReceiver(ctx, brokerURL, topics, opts...)
+			if err != nil {
+				log.Fatalf("failed to create message receiver: %s", err)
+			}
+			receivers = append(receivers, recv)
+			continue
+		}
+		opts := []internal.MQTTReceiverOpt{
+			internal.WithIgnoreTopicErrors(ignoreTopicErrs),
+			internal.WithEnvCredentials("WIS"),
+			internal.WithEnvCredentials("WIS2"),
+			internal.WithProtocolVersion(protocolVersion),
+			internal.WithClientID(clientID),
+			internal.WithSessionExpiry(sessionExpiry),
+			internal.WithTLSProvider(tlsProvider),
+			internal.WithHeaders(header),
+			// With multiple brokers an unavailable broker should not prevent
+			// receiving from the others
+			internal.WithConnectRetry(len(brokerURLs) > 1),
+		}
+		if proxyURL != nil {
+			opts = append(opts, internal.WithProxy(proxyURL))
+		}
+		if shareGroup != "" {
+			opts = append(opts, internal.WithShareGroup(shareGroup))
+		}
+		if recorder != nil {
+			opts = append(opts, internal.WithRecorder(recorder))
+		}
+		recv, err := internal.NewMQTTReceiver(ctx, brokerURL, topics, opts...)
+		if err != nil {
+			log.Fatalf("failed to create message receiver: %s", err)
+		}
+		receivers = append(receivers, recv)
+	}
+	// Products written alongside notification files can be ingested using file:// URLs
+	if len(dirRoots) > 0 {
+		defaultFetcherFactory = internal.NewFileFetcherFactory(defaultFetcherFactory, dirRoots...)
+	}
+	receiver := receivers[0]
+	if len(receivers) > 1 {
+		receiver = internal.NewMultiReceiver(ctx, receivers, internal.WithFailover(failover))
 	}
 
-	repo, err := internal.NewRepo(dataDir)
+	repoOpts := []internal.RepoOpt{internal.WithSidecars(sidecar)}
+	if layout != "" {
+		repoOpts = append(repoOpts, internal.WithLayout(layout))
+	}
+	repo, err := internal.NewRepo(dataDir, repoOpts...)
 	if err != nil {
 		log.Fatalf("failed to create data repository: %s", err)
 	}
 
 	service := newService(receiver, repo, command, verbose)
+	service.filters = filters
+
+	if dedupTTL > 0 {
+		if dedupDB == "" {
+			dedupDB = filepath.Join(dataDir, ".seen.db")
+			if shareGroup != "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					log.Fatalf("failed to get hostname: %s", err)
+				}
+				dedupDB = filepath.Join(dataDir, ".seen-"+hostname+".db")
+			}
+		}
+		seen, err := internal.NewBoltSeenStore(dedupDB, dedupTTL)
+		if err != nil {
+			log.Fatalf("failed to open dedup database: %s", err)
+		}
+		defer seen.Close()
+		service.seen = seen
+
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if _, err := seen.Expire(); err != nil {
+						log.Printf("failed to expire dedup entries: %s", err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Periodically report schema validation failures so bad publishers can be
+	// reported upstream
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				validator.Report()
+			}
+		}
+	}()
+
 	if err := service.Run(ctx, workers); err != nil {
 		log.Fatalf("failed! %s", err)
 	}
+	validator.Report()
 
   return nil
 }
@@ -2,15 +2,13 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -31,6 +29,10 @@ type service struct {
 	repo     internal.Repo
 	executor internal.Executor
 	command  string
+	// filters must all accept a message for it to be ingested
+	filters []internal.Filter
+	// seen, if not nil, is used to drop duplicate messages
+	seen internal.SeenStore
 }
 
 func newService(recv internal.Receiver, repo internal.Repo, command string, verbose bool) service {
@@ -45,22 +47,72 @@ func newService(recv internal.Receiver, repo internal.Repo, command string, verb
 	}
 }
 
+// filterMessage returns an error describing why the message was rejected if any
+// filter rejects it.
+func (svc *service) filterMessage(msg *internal.Message) error {
+	for _, f := range svc.filters {
+		if err := f.Accept(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDuplicate records the message as pending, returning true if it has
+// already been seen. Errors are logged and the message is not considered a
+// duplicate.
+func (svc *service) isDuplicate(msg *internal.Message) bool {
+	if svc.seen == nil {
+		return false
+	}
+	seen, err := svc.seen.Seen(internal.MessageKeys(msg)...)
+	if err != nil {
+		svc.log.Error("failed to execute seen check: %s", err)
+		return false
+	}
+	return seen
+}
+
+// ack acknowledges the message to its receiver, or negatively acknowledges it
+// if ok is false.
+func (svc *service) ack(msg *internal.Message, ok bool) {
+	var err error
+	if ok {
+		err = msg.Ack()
+	} else {
+		err = msg.Nack()
+	}
+	if err != nil {
+		svc.log.Error("failed to acknowledge topic='%s' url='%s': %s", msg.Topic, msg.Payload.URL(), err)
+	}
+}
+
 // validateMessage returns an error if the message likely will not be able to
 // be downloaded, nil if it's ok to try an ingest.
 func (svc *service) validateMessage(msg *internal.Message) error {
-	// Verify message is valid
 	topic := msg.Topic
-	name := path.Base(msg.Payload.RelPath)
-	if err := msg.Payload.IsValid(); err != nil {
+	name := msg.Payload.Name()
+	action := msg.Payload.Action()
+
+	// Deletes only need to know what file to delete
+	if action == internal.ActionDelete {
+		if name == "" {
+			return fmt.Errorf("invalid; topic='%s' message='%+v' unable to determine file name", topic, msg)
+		}
+	} else if err := msg.Payload.IsValid(); err != nil {
 		return fmt.Errorf("invalid; topic='%s' name='%s' message='%+v' %s", topic, name, msg, err)
 	}
-	// Verify it doesn't already exist
-	exists, err := svc.repo.Exists(topic, name)
-	if err != nil {
-		return fmt.Errorf("failed to execute exists check, skipping!: %s", err)
-	}
-	if exists {
-		return fmt.Errorf("skipping! exists locally topic='%s' name='%s'", topic, name)
+
+	// A new file with the same name as an existing one may be a different data
+	// item, so it is left to Store to report whether it can be stored
+	if action == internal.ActionDelete {
+		exists, err := svc.repo.Exists(topic, name)
+		if err != nil {
+			return fmt.Errorf("failed to execute exists check, skipping!: %s", err)
+		}
+		if !exists {
+			return fmt.Errorf("skipping delete! does not exist locally topic='%s' name='%s'", topic, name)
+		}
 	}
 	return nil
 }
@@ -87,9 +139,21 @@ func (svc *service) Run(ctx context.Context, numWorkers int) error {
 		defer wg.Done()
 		for svc.receiver.Next() {
 			msg := svc.receiver.Message()
-			svc.log.Info("received topic='%s' url='%s'", msg.Topic, msg.Payload.URL())
+			svc.log.Info("received topic='%s' url='%s' action=%s", msg.Topic, msg.Payload.URL(), msg.Payload.Action())
+			// Messages that will not be ingested are acknowledged so they are not redelivered
+			if err := svc.filterMessage(msg); err != nil {
+				svc.log.Debug("filtered topic='%s' url='%s': %s", msg.Topic, msg.Payload.URL(), err)
+				svc.ack(msg, true)
+				continue
+			}
 			if err := svc.validateMessage(msg); err != nil {
 				svc.log.Info("skipping! %s", err)
+				svc.ack(msg, true)
+				continue
+			}
+			if svc.isDuplicate(msg) {
+				svc.log.Info("skipping! duplicate topic='%s' id='%s' url='%s'", msg.Topic, msg.Payload.ID, msg.Payload.URL())
+				svc.ack(msg, true)
 				continue
 			}
 			svc.log.Debug("submitting: %+v", msg)
@@ -106,21 +170,62 @@ func (svc *service) Run(ctx context.Context, numWorkers int) error {
 			f := zult.Result
 			topic := zult.Result.msg.Topic
 			url := zult.Result.msg.Payload.URL()
+			if errors.Is(zult.Err, os.ErrExist) {
+				// Another file with the same name is stored, so retrying will not
+				// store this one
+				svc.log.Warn("%s failed topic='%s' url='%s': exists locally: %s", f.action, topic, url, zult.Err)
+				if svc.seen != nil {
+					if err := svc.seen.Done(internal.MessageKeys(f.msg)...); err != nil {
+						svc.log.Error("failed to record message as seen: %s", err)
+					}
+				}
+				svc.ack(f.msg, true)
+				continue
+			}
 			if zult.Err != nil {
-				svc.log.Error("ingest failed topic='%s' url='%s': %s", url, topic, zult.Err)
+				svc.log.Error("%s failed topic='%s' url='%s': %s", f.action, topic, url, zult.Err)
+				// allow it to be retried if received again
+				if svc.seen != nil {
+					if err := svc.seen.Forget(internal.MessageKeys(f.msg)...); err != nil {
+						svc.log.Error("failed to forget message: %s", err)
+					}
+				}
+				svc.ack(f.msg, false)
 				continue
 			}
 
-			svc.log.Info("ingested %s to %s in %v", url, f.path, zult.Finished.Sub(zult.Started))
+			// only now is the message seen, so it is ingested if redelivered after
+			// a restart during ingest
+			if svc.seen != nil {
+				if err := svc.seen.Done(internal.MessageKeys(f.msg)...); err != nil {
+					svc.log.Error("failed to record message as seen: %s", err)
+				}
+			}
+
+			switch {
+			case f.action == internal.ActionDelete:
+				svc.log.Info("deleted %s", f.path)
+			case f.inline:
+				svc.log.Info("ingested inline content for %s to %s", url, f.path)
+			default:
+				svc.log.Info("ingested %s to %s in %v", url, f.path, zult.Finished.Sub(zult.Started))
+			}
 			if svc.command == "" {
+				svc.ack(f.msg, true)
 				continue
 			}
 			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-			svc.log.Debug("executing '%s %s %s'", svc.command, topic, f.path)
-			if err := svc.executor(ctx, svc.command, topic, f.path); err != nil {
+			svc.log.Debug("executing '%s %s %s %s'", svc.command, topic, f.path, f.action)
+			var env []string
+			if t, err := internal.ParseTopic(topic); err == nil {
+				env = t.Env()
+			}
+			err := svc.executor(ctx, env, svc.command, topic, f.path, string(f.action))
+			if err != nil {
 				svc.log.Error("command failed on %s: %s", f.path, err)
 			}
 			cancel()
+			svc.ack(f.msg, err == nil)
 		}
 		svc.log.Debug("no more results")
 	}()
@@ -153,10 +258,19 @@ type taskResult struct {
 func (svc service) worker(wg *sync.WaitGroup, in <-chan task, out chan<- taskResult) {
 	defer wg.Done()
 	for task := range in {
-		i, err := ingestOne(task.msg, task.repo)
+		var i ingestResult
+		var err error
+		started := time.Now()
+		if task.msg.Payload.Action() == internal.ActionDelete {
+			i, err = deleteOne(task.msg, task.repo)
+		} else {
+			i, err = ingestOne(task.msg, task.repo)
+		}
 		out <- taskResult{
-			Result: i,
-			Err:    err,
+			Result:   i,
+			Err:      err,
+			Started:  started,
+			Finished: time.Now(),
 		}
 	}
 	svc.log.Debug("worker exiting")
@@ -165,55 +279,135 @@ func (svc service) worker(wg *sync.WaitGroup, in <-chan task, out chan<- taskRes
 type ingestResult struct {
 	msg  *internal.Message
 	path string
+	// inline is true if the data was included in the message rather than fetched
+	inline bool
+	action internal.Action
+}
+
+func deleteOne(msg *internal.Message, repo internal.Repo) (ingestResult, error) {
+	zult := ingestResult{msg: msg, action: internal.ActionDelete}
+	var err error
+	zult.path, err = repo.Delete(msg.Topic, msg.Payload.Name())
+	return zult, err
 }
 
 func ingestOne(msg *internal.Message, repo internal.Repo) (ingestResult, error) {
 	wis := msg.Payload
 	url := wis.URL()
-	zult := ingestResult{msg: msg}
-	fetcher := defaultFetcherFactory(url)
+	zult := ingestResult{msg: msg, action: wis.Action()}
 
-	// Fetch the file to a temporary location
-	tmp, err := os.CreateTemp("", path.Base(url)+".*")
+	// Write the file to a temporary directory so it has the correct name when it
+	// is moved into the repo
+	dir, err := os.MkdirTemp("", "wis2-")
+	if err != nil {
+		return zult, fmt.Errorf("creating tmp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp, err := os.Create(filepath.Join(dir, wis.Name()))
 	if err != nil {
 		return zult, fmt.Errorf("creating tmp: %w", err)
 	}
 	defer tmp.Close()
-	if err := fetcher.Fetch(url, tmp); err != nil {
-		return zult, fmt.Errorf("fetching: %w", err)
+
+	// Hash the data as it is written, aborting if it exceeds the advertised size
+	w, err := newIngestWriter(tmp, wis.Integrity.Method, wis.Size)
+	if err != nil {
+		return zult, fmt.Errorf("integrity check failed: %w", err)
+	}
+
+	// Use data included in the message if available, otherwise fetch it
+	if data, ok := wis.InlineData(); ok {
+		zult.inline = true
+		if _, err := w.Write(data); err != nil {
+			return zult, fmt.Errorf("writing inline content: %w", err)
+		}
+	} else {
+		fetcher := defaultFetcherFactory(url)
+		if fetcher == nil {
+			return zult, fmt.Errorf("no fetcher for url")
+		}
+		if err := fetcher.Fetch(url, w); err != nil {
+			return zult, fmt.Errorf("fetching: %w", err)
+		}
 	}
 	tmp.Sync() // make sure it's all written to disk
 
-	// verify checksum
-	if err := verifyWISChecksum(wis.Integrity.Method, wis.Integrity.Value, tmp); err != nil {
-		return zult, fmt.Errorf("integrity check failed: %w", err)
+	if err := w.verify(wis.Integrity.Value); err != nil {
+		return zult, err
 	}
 
-	zult.path, err = repo.Store(msg.Topic, tmp.Name())
+	if zult.action == internal.ActionUpdate {
+		zult.path, err = repo.Replace(msg.Topic, tmp.Name(), msg)
+	} else {
+		zult.path, err = repo.Store(msg.Topic, tmp.Name(), msg)
+	}
 	return zult, err
 }
 
-func verifyWISChecksum(method, expected string, r io.Reader) error {
+// sizeError indicates the amount of data ingested does not match the size
+// advertised by the message.
+type sizeError struct {
+	expected, got int64
+	// exceeded is true if ingest was aborted because it exceeded the expected size,
+	// in which case got is the size at the time it was aborted.
+	exceeded bool
+}
+
+func (e *sizeError) Error() string {
+	if e.exceeded {
+		return fmt.Sprintf("size mismatch; expected=%d got>=%d", e.expected, e.got)
+	}
+	return fmt.Sprintf("size mismatch; expected=%d got=%d", e.expected, e.got)
+}
+
+// ingestWriter hashes data as it is written to dst and aborts writes that would
+// exceed the expected size, if the expected size is known.
+type ingestWriter struct {
+	dst      io.Writer
+	method   string
+	hash     hash.Hash // nil if the message has no integrity
+	expected int64     // <= 0 if unknown
+	written  int64
+}
+
+func newIngestWriter(dst io.Writer, method string, expected int64) (*ingestWriter, error) {
 	method = strings.ToLower(method)
-	var alg hash.Hash
-	switch method {
-	case "md5":
-		alg = md5.New()
-	case "sha512":
-		alg = sha512.New()
-	case "sha256":
-		alg = sha256.New()
-	default:
-		return fmt.Errorf("unsupported method '%s'", method)
+	w := &ingestWriter{dst: dst, method: method, expected: expected}
+	if method == "" {
+		return w, nil
 	}
+	alg, err := internal.NewHash(method)
+	if err != nil {
+		return nil, err
+	}
+	w.hash = alg
+	return w, nil
+}
 
-	if _, err := io.Copy(alg, r); err != nil {
-		return fmt.Errorf("executing; method='%s': %w", method, err)
+func (w *ingestWriter) Write(p []byte) (int, error) {
+	if w.expected > 0 && w.written+int64(len(p)) > w.expected {
+		return 0, &sizeError{expected: w.expected, got: w.written + int64(len(p)), exceeded: true}
+	}
+	n, err := w.dst.Write(p)
+	if w.hash != nil {
+		w.hash.Write(p[:n])
 	}
+	w.written += int64(n)
+	return n, err
+}
 
-	got := hex.EncodeToString(alg.Sum(nil))
+// verify the size and checksum of the data written. The checksum is not
+// verified if the message has no integrity.
+func (w *ingestWriter) verify(expected string) error {
+	if w.expected > 0 && w.written != w.expected {
+		return &sizeError{expected: w.expected, got: w.written}
+	}
+	if w.hash == nil {
+		return nil
+	}
+	got := hex.EncodeToString(w.hash.Sum(nil))
 	if got != expected {
-		return fmt.Errorf("mismatch; method='%s' expected='%s' got='%s'", method, expected, got)
+		return fmt.Errorf("integrity check failed: mismatch; method='%s' expected='%s' got='%s'", w.method, expected, got)
 	}
 	return nil
 }
@@ -3,8 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,7 +37,7 @@ func (r *mockReceiver) Next() bool { return r.messages != nil }
 func (r *mockReceiver) Err() error { return r.err }
 
 func newMockExecutor(err error) internal.Executor {
-	return func(ctx context.Context, name string, args ...string) error {
+	return func(ctx context.Context, env []string, name string, args ...string) error {
 		return err
 	}
 }
@@ -43,7 +48,16 @@ type mockRepo struct {
 	stored map[string]string
 }
 
-func (r *mockRepo) Store(topic string, name string) (string, error) { return "<nope>", r.err }
+func (r *mockRepo) Store(topic, name string, msg *internal.Message) (string, error) {
+	return "<nope>", r.err
+}
+func (r *mockRepo) Replace(topic, name string, msg *internal.Message) (string, error) {
+	return "<nope>", r.err
+}
+func (r *mockRepo) Delete(topic string, name string) (string, error) { return "<nope>", r.err }
+func (r *mockRepo) Sidecar(topic string, name string) (*internal.Sidecar, error) {
+	return nil, os.ErrNotExist
+}
 func (r *mockRepo) Get(topic string, name string) (*os.File, error) {
 	return os.CreateTemp("", "")
 }
@@ -73,6 +87,71 @@ func newStaticFetcherFactory(f internal.Fetcher) internal.FetcherFactory {
 	}
 }
 
+func TestServiceAck(t *testing.T) {
+	defaultFetcherFactory = newStaticFetcherFactory(&mockFetcher{})
+	// mockFetcher writes the URL as the data
+	valid := fmt.Sprintf("%x", md5.Sum([]byte("test:/foo/path/file.ext")))
+	tests := []struct {
+		Name        string
+		Integrity   string
+		StoreErr    error
+		ExecErr     error
+		ExpectedAck bool
+		// ExpectedSeen is whether the message is a duplicate after a restart
+		ExpectedSeen bool
+	}{
+		{"ingested", valid, nil, nil, true, true},
+		{"ingest failed", "00000000000000000000000000000000", nil, nil, false, false},
+		{"exists locally", valid, fmt.Errorf("a/b/c/file.ext: %w", os.ErrExist), nil, true, true},
+		{"command failed", valid, nil, errors.New("failed"), false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := &internal.Message{
+				Topic: "a/b/c",
+				Payload: internal.WISMessage{
+					BaseURL:   "test://foo",
+					RelPath:   "path/file.ext",
+					Integrity: internal.Integrity{Method: "md5", Value: test.Integrity},
+				},
+			}
+			acks := []bool{}
+			msg.SetAck(func(ok bool) error {
+				acks = append(acks, ok)
+				return nil
+			})
+			dbPath := filepath.Join(t.TempDir(), "seen.db")
+			seen, err := internal.NewBoltSeenStore(dbPath, time.Hour)
+			if err != nil {
+				t.Fatalf("failed to open seen store: %s", err)
+			}
+			svc := service{
+				receiver: &mockReceiver{messages: []*internal.Message{msg}},
+				repo:     &mockRepo{stored: map[string]string{}, err: test.StoreErr},
+				executor: newMockExecutor(test.ExecErr),
+				command:  "cmd",
+				seen:     seen,
+			}
+			if err := svc.Run(context.Background(), 1); err != nil {
+				t.Fatalf("got err %s", err)
+			}
+			if len(acks) != 1 || acks[0] != test.ExpectedAck {
+				t.Errorf("expected a single ack=%v, got %v", test.ExpectedAck, acks)
+			}
+
+			seen.Close()
+			seen, err = internal.NewBoltSeenStore(dbPath, time.Hour)
+			if err != nil {
+				t.Fatalf("failed to reopen seen store: %s", err)
+			}
+			defer seen.Close()
+			if got, _ := seen.Seen(internal.MessageKeys(msg)...); got != test.ExpectedSeen {
+				t.Errorf("expected seen=%v after restart, got %v", test.ExpectedSeen, got)
+			}
+		})
+	}
+}
+
 func TestService(t *testing.T) {
 	defaultFetcherFactory = newStaticFetcherFactory(&mockFetcher{})
 	now := time.Now()
@@ -108,3 +187,259 @@ func TestService(t *testing.T) {
 		t.Errorf("got err %s", err)
 	}
 }
+
+func TestServiceFileReplay(t *testing.T) {
+	defaultFetcherFactory = newStaticFetcherFactory(&mockFetcher{})
+	dir := t.TempDir()
+	lines := []string{}
+	for _, name := range []string{"one.txt", "two.txt"} {
+		// mockFetcher writes the URL as the data
+		sum := md5.Sum([]byte("test:/foo/path/" + name))
+		lines = append(lines, fmt.Sprintf(
+			`{"baseUrl": "test://foo", "relPath": "path/%s", "integrity": {"method": "md5", "value": "%x"}}`, name, sum))
+	}
+	fpath := filepath.Join(dir, "notifications.jsonl")
+	if err := os.WriteFile(fpath, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	recv, err := internal.NewFileReceiver(context.Background(), "file://"+fpath+"?topic=a/b/c", []string{"a/#"})
+	if err != nil {
+		t.Fatalf("failed to create receiver: %s", err)
+	}
+	repo, err := internal.NewRepo(dir)
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+
+	svc := newService(recv, repo, "", false)
+	if err := svc.Run(context.Background(), 2); err != nil {
+		t.Fatalf("got err %s", err)
+	}
+	for _, name := range []string{"one.txt", "two.txt"} {
+		if ok, _ := repo.Exists("a/b/c", name); !ok {
+			t.Errorf("expected %s to be ingested", name)
+		}
+	}
+}
+
+type failingFetcher struct{}
+
+func (f *failingFetcher) FetchContext(ctx context.Context, url string, dst io.Writer) error {
+	return fmt.Errorf("should not fetch")
+}
+func (f *failingFetcher) Fetch(url string, dst io.Writer) error {
+	return f.FetchContext(context.Background(), url, dst)
+}
+
+// chunkFetcher writes its data in single byte chunks, recording how much was
+// successfully written.
+type chunkFetcher struct {
+	data    string
+	written int
+}
+
+func (f *chunkFetcher) FetchContext(ctx context.Context, url string, dst io.Writer) error {
+	for i := 0; i < len(f.data); i++ {
+		if _, err := dst.Write([]byte{f.data[i]}); err != nil {
+			return err
+		}
+		f.written++
+	}
+	return nil
+}
+func (f *chunkFetcher) Fetch(url string, dst io.Writer) error {
+	return f.FetchContext(context.Background(), url, dst)
+}
+
+func TestIngestOne(t *testing.T) {
+	repo, err := internal.NewRepo(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create repo: %s", err)
+	}
+	newMsg := func(content *internal.Content) *internal.Message {
+		return &internal.Message{
+			Topic: "a/b/c",
+			Payload: internal.WISMessage{
+				Links: []internal.Link{{Href: "https://host/path/file.txt", Rel: "canonical"}},
+				Integrity: internal.Integrity{
+					Method: "md5",
+					Value:  "5d41402abc4b2a76b9719d911017c592", // md5 of 'hello'
+				},
+				Content: content,
+			},
+		}
+	}
+
+	t.Run("inline", func(t *testing.T) {
+		defaultFetcherFactory = newStaticFetcherFactory(&failingFetcher{})
+		zult, err := ingestOne(newMsg(&internal.Content{Encoding: "utf-8", Value: "hello", Size: 5}), repo)
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		if !zult.inline {
+			t.Errorf("expected inline ingest")
+		}
+		if filepath.Base(zult.path) != "file.txt" {
+			t.Errorf("expected file named file.txt, got %s", zult.path)
+		}
+		got, err := os.ReadFile(zult.path)
+		if err != nil || string(got) != "hello" {
+			t.Errorf("expected stored content 'hello', got '%s' err=%v", got, err)
+		}
+	})
+
+	t.Run("inline checksum mismatch", func(t *testing.T) {
+		defaultFetcherFactory = newStaticFetcherFactory(&failingFetcher{})
+		_, err := ingestOne(newMsg(&internal.Content{Encoding: "utf-8", Value: "olleh", Size: 5}), repo)
+		if err == nil {
+			t.Errorf("expected integrity error")
+		}
+	})
+
+	t.Run("fetch", func(t *testing.T) {
+		defaultFetcherFactory = newStaticFetcherFactory(&chunkFetcher{data: "hello"})
+		msg := newMsg(nil)
+		msg.Payload.Links[0].Href = "https://host/path/fetched.txt"
+		msg.Payload.Size = 5
+		zult, err := ingestOne(msg, repo)
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		got, err := os.ReadFile(zult.path)
+		if err != nil || string(got) != "hello" {
+			t.Errorf("expected stored content 'hello', got '%s' err=%v", got, err)
+		}
+	})
+
+	t.Run("no integrity", func(t *testing.T) {
+		defaultFetcherFactory = newStaticFetcherFactory(&chunkFetcher{data: "hello"})
+		msg := newMsg(nil)
+		msg.Payload.Links[0].Href = "https://host/path/unverified.txt"
+		msg.Payload.Integrity = internal.Integrity{}
+		zult, err := ingestOne(msg, repo)
+		if err != nil {
+			t.Fatalf("expected no error, got %s", err)
+		}
+		got, err := os.ReadFile(zult.path)
+		if err != nil || string(got) != "hello" {
+			t.Errorf("expected stored content 'hello', got '%s' err=%v", got, err)
+		}
+	})
+
+	t.Run("exceeding size aborts fetch", func(t *testing.T) {
+		fetcher := &chunkFetcher{data: "hello world"}
+		defaultFetcherFactory = newStaticFetcherFactory(fetcher)
+		msg := newMsg(nil)
+		msg.Payload.Size = 5
+		_, err := ingestOne(msg, repo)
+		var serr *sizeError
+		if !errors.As(err, &serr) || !serr.exceeded {
+			t.Fatalf("expected exceeded size error, got %v", err)
+		}
+		if fetcher.written != 5 {
+			t.Errorf("expected fetch to be aborted after 5 bytes, wrote %d", fetcher.written)
+		}
+	})
+
+	t.Run("short size", func(t *testing.T) {
+		defaultFetcherFactory = newStaticFetcherFactory(&chunkFetcher{data: "hello"})
+		msg := newMsg(nil)
+		msg.Payload.Size = 10
+		_, err := ingestOne(msg, repo)
+		var serr *sizeError
+		if !errors.As(err, &serr) || serr.exceeded || serr.got != 5 {
+			t.Fatalf("expected size error, got %v", err)
+		}
+	})
+
+	t.Run("truncated falls back to fetch", func(t *testing.T) {
+		defaultFetcherFactory = newStaticFetcherFactory(&failingFetcher{})
+		_, err := ingestOne(newMsg(&internal.Content{Encoding: "utf-8", Value: "hel", Size: 5}), repo)
+		if err == nil || !strings.Contains(err.Error(), "should not fetch") {
+			t.Errorf("expected fetch to be attempted, got %v", err)
+		}
+	})
+}
+
+func TestValidateMessage(t *testing.T) {
+	newMsg := func(rel string) *internal.Message {
+		return &internal.Message{
+			Topic: "a/b/c",
+			Payload: internal.WISMessage{
+				Links: []internal.Link{{Href: "https://host/path/file.txt", Rel: rel}},
+				Integrity: internal.Integrity{
+					Method: "md5",
+					Value:  "5d41402abc4b2a76b9719d911017c592",
+				},
+			},
+		}
+	}
+	tests := []struct {
+		Name        string
+		Rel         string
+		Exists      bool
+		ExpectError bool
+	}{
+		{"new", "canonical", false, false},
+		{"new exists", "canonical", true, false},
+		{"update", "update", false, false},
+		{"update exists", "update", true, false},
+		{"delete", "deletion", true, false},
+		{"delete does not exist", "deletion", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			svc := service{repo: &mockRepo{exists: test.Exists}}
+			err := svc.validateMessage(newMsg(test.Rel))
+			if test.ExpectError && err == nil {
+				t.Errorf("expected error")
+			}
+			if !test.ExpectError && err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+type mockFilter struct{ err error }
+
+func (f mockFilter) Accept(msg *internal.Message) error { return f.err }
+
+func TestFilterMessage(t *testing.T) {
+	svc := service{filters: []internal.Filter{mockFilter{}, mockFilter{fmt.Errorf("nope")}}}
+	if err := svc.filterMessage(&internal.Message{}); err == nil || err.Error() != "nope" {
+		t.Errorf("expected rejection from second filter, got %v", err)
+	}
+	svc.filters = svc.filters[:1]
+	if err := svc.filterMessage(&internal.Message{}); err != nil {
+		t.Errorf("expected accept, got %s", err)
+	}
+}
+
+func TestIsDuplicate(t *testing.T) {
+	seen, err := internal.NewBoltSeenStore(filepath.Join(t.TempDir(), "seen.db"), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to open seen store: %s", err)
+	}
+	defer seen.Close()
+	svc := service{seen: seen}
+
+	origin := &internal.Message{
+		Topic:   "origin/a/wis2/x/data/core/weather",
+		Payload: internal.WISMessage{ID: "1234", DataID: "x/file"},
+	}
+	cache := &internal.Message{
+		Topic:   "cache/a/wis2/x/data/core/weather",
+		Payload: internal.WISMessage{ID: "1234", DataID: "x/file"},
+	}
+	if svc.isDuplicate(origin) {
+		t.Errorf("first message should not be a duplicate")
+	}
+	if !svc.isDuplicate(cache) {
+		t.Errorf("same message on another topic should be a duplicate")
+	}
+	other := &internal.Message{Topic: origin.Topic, Payload: internal.WISMessage{ID: "5678", DataID: "x/other"}}
+	if svc.isDuplicate(other) {
+		t.Errorf("distinct message should not be a duplicate")
+	}
+}